@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// States of an approval request
+	ApprovalPending   = "pending"
+	ApprovalApproved  = "approved"
+	ApprovalRejected  = "rejected"
+	ApprovalExpired   = "expired"
+	ApprovalCancelled = "cancelled"
+
+	// Default time an approval request waits for approvers
+	defaultApprovalExpiry = 24 * time.Hour
+
+	// How long the MFA token of an approval is masked
+	mfaTokenLifetime = 10 * time.Minute
+
+	// Buttons and inputs of the approval request message
+	SlackApproveAction     = "approval_approve"
+	SlackRejectAction      = "approval_reject"
+	SlackApprovalMFABlock  = "approval_mfa"
+	SlackApprovalMFAAction = "approval_mfa_value"
+
+	// Input of the forms that asks the requester why an action is needed
+	SlackJustificationBlock  = "justification"
+	SlackJustificationAction = "justification_value"
+)
+
+// approvalPolicy can be added to any project or workflow to require
+// approvals before running it
+type approvalPolicy struct {
+	// Slack user group (subteam ID) whose members can approve, required
+	ApproverGroup string `toml:"approver_group"`
+
+	// Number of different approvers needed, defaults to one
+	Approvals int `toml:"approvals,omitempty"`
+
+	// Name of the variable (KEY=VALUE) that receives the MFA token
+	// typed by the last approver, no MFA token is asked if empty
+	MFAInput string `toml:"mfa_input,omitempty"`
+
+	// Whether the requester has to explain why the action is needed
+	Justification bool `toml:"justification,omitempty"`
+
+	// How long the request waits for approvals, defaults to 24h
+	Expiry duration `toml:"expiry,omitempty"`
+}
+
+// duration is a time.Duration that can be decoded from strings like "1h30m"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// RequiredApprovals returns the number of approvals the policy needs
+func (policy *approvalPolicy) RequiredApprovals() int {
+	if policy.Approvals < 1 {
+		return 1
+	}
+	return policy.Approvals
+}
+
+// ExpiresAfter returns how long a request waits for approvals
+func (policy *approvalPolicy) ExpiresAfter() time.Duration {
+	if policy.Expiry.Duration <= 0 {
+		return defaultApprovalExpiry
+	}
+	return policy.Expiry.Duration
+}
+
+// canApprove returns true if the user is allowed to approve requests of the
+// policy, otherwise it returns the reason to show to the user. Without an
+// approver group nobody can approve
+func (policy *approvalPolicy) canApprove(ctx context.Context, api *slack.Client, user string) (bool, string) {
+	if policy.ApproverGroup == "" {
+		return false, "This request has no approver group, nobody can approve it."
+	}
+
+	member, err := isUserGroupMember(ctx, api, policy.ApproverGroup, user)
+	if err != nil {
+		logger.Errorw("unable to get members of approver group",
+			"group", policy.ApproverGroup, "error", err)
+		return false, "I was unable to verify that you are an approver, try again later."
+	}
+	if !member {
+		return false, fmt.Sprintf("Only members of <!subteam^%s> can approve this request.", policy.ApproverGroup)
+	}
+	return true, ""
+}
+
+// approvalTarget is the action that runs once a request is approved
+type approvalTarget struct {
+	// Kind is either 'project' or 'workflow'
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name"`
+	Variables []string `json:"variables,omitempty"`
+
+	// Branch and commit picked for the release of a project
+	Ref string `json:"ref,omitempty"`
+	Sha string `json:"sha,omitempty"`
+}
+
+const (
+	ApprovalTargetProject  = "project"
+	ApprovalTargetWorkflow = "workflow"
+)
+
+type approver struct {
+	User string    `json:"user"`
+	At   time.Time `json:"at"`
+}
+
+// approvalRequest is a request for approvals to run an action
+type approvalRequest struct {
+	mu sync.Mutex
+
+	ID            string
+	Title         string
+	Details       string
+	Target        approvalTarget
+	Policy        approvalPolicy
+	Requester     string
+	Justification string
+	Approvers     []approver
+	RejectedBy    string
+	State         string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+
+	// where the request was posted
+	Channel   string
+	Timestamp string
+}
+
+// approvals are the approval requests that are still in memory
+var approvals = struct {
+	sync.Mutex
+	requests map[string]*approvalRequest
+}{requests: map[string]*approvalRequest{}}
+
+// requestApproval posts an approval request to the provided channel, the
+// target runs once the policy is satisfied
+func requestApproval(ctx context.Context, api *slack.Client, config *c, req *approvalRequest) {
+	req.ID = newRandomID()
+	req.State = ApprovalPending
+	req.CreatedAt = time.Now()
+	req.ExpiresAt = req.CreatedAt.Add(req.Policy.ExpiresAfter())
+
+	approvals.Lock()
+	approvals.requests[req.ID] = req
+	approvals.Unlock()
+
+	req.Timestamp = postSlackMessage(ctx, api, req.Channel,
+		slack.MsgOptionText("Approval required: "+req.Title, false),
+		slack.MsgOptionBlocks(renderApprovalRequest(req)...),
+	)
+
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf("User <@%s> requested approval for *%s* :hourglass:", req.Requester, req.Title),
+	)
+
+	time.AfterFunc(time.Until(req.ExpiresAt), func() {
+		req.mu.Lock()
+		defer req.mu.Unlock()
+		if req.State != ApprovalPending {
+			return
+		}
+		req.State = ApprovalExpired
+		updateSlackMessage(context.Background(), api, req.Channel, req.Timestamp,
+			slack.MsgOptionBlocks(renderApprovalRequest(req)...),
+		)
+		forgetApproval(req.ID)
+		req.Record(AuditEventApprovalExpired, "")
+		req.observeWait()
+	})
+}
+
+// cancelPendingApprovals cancels the requests still waiting for approvals,
+// they live in memory and can't be approved after a restart
+func cancelPendingApprovals(ctx context.Context, api *slack.Client) int {
+	approvals.Lock()
+	pending := make([]*approvalRequest, 0, len(approvals.requests))
+	for id, req := range approvals.requests {
+		pending = append(pending, req)
+		delete(approvals.requests, id)
+	}
+	approvals.Unlock()
+
+	cancelled := 0
+	for _, req := range pending {
+		req.mu.Lock()
+		if req.State == ApprovalPending {
+			req.State = ApprovalCancelled
+			updateSlackMessage(ctx, api, req.Channel, req.Timestamp,
+				slack.MsgOptionBlocks(renderApprovalRequest(req)...),
+			)
+			req.Record(AuditEventApprovalCancelled, "ally restarted")
+			cancelled++
+		}
+		req.mu.Unlock()
+	}
+	return cancelled
+}
+
+func findApproval(id string) (*approvalRequest, bool) {
+	approvals.Lock()
+	defer approvals.Unlock()
+	req, ok := approvals.requests[id]
+	return req, ok
+}
+
+func forgetApproval(id string) {
+	approvals.Lock()
+	defer approvals.Unlock()
+	delete(approvals.requests, id)
+}
+
+// handleApprovalAction handles a click on the Approve or Reject buttons
+// of an approval request
+func handleApprovalAction(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback, action *slack.BlockAction) error {
+	req, ok := findApproval(action.Value)
+	if !ok {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, callback.User.ID,
+			":warning: This approval request is no longer active.")
+		return nil
+	}
+
+	// clicks are handled one at a time per request, so that double clicks
+	// or approvers clicking at the same time can't run the target twice
+	req.mu.Lock()
+	defer req.mu.Unlock()
+
+	if req.State == ApprovalPending && time.Now().After(req.ExpiresAt) {
+		req.State = ApprovalExpired
+	}
+	if req.State != ApprovalPending {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, callback.User.ID,
+			fmt.Sprintf(":warning: This approval request is already %s.", req.State))
+		return nil
+	}
+
+	user := callback.User.ID
+
+	// the requester can withdraw the request, but never approve it
+	if user == req.Requester && action.ActionID == SlackApproveAction {
+		logger.Warnw("self-approval attempt", "id", req.ID, "title", req.Title, "user", user)
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user,
+			":no_entry: You can't approve your own request, someone else has to do it.")
+		return nil
+	}
+
+	if user != req.Requester {
+		if allowed, reason := req.Policy.canApprove(ctx, api, user); !allowed {
+			logger.Warnw("unauthorized approval attempt",
+				"id", req.ID, "title", req.Title, "user", user, "reason", reason)
+			postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user, ":no_entry: "+reason)
+			return nil
+		}
+	}
+
+	if action.ActionID == SlackRejectAction {
+		req.State = ApprovalRejected
+		req.RejectedBy = user
+		forgetApproval(req.ID)
+		req.Record(AuditEventApprovalRejected, "rejected by "+user)
+		req.observeWait()
+		updateSlackMessage(ctx, api, req.Channel, req.Timestamp,
+			slack.MsgOptionBlocks(renderApprovalRequest(req)...),
+		)
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			fmt.Sprintf("User <@%s> rejected *%s* :no_entry:", user, req.Title),
+		)
+		return nil
+	}
+
+	if req.HasApproved(user) {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user,
+			":warning: You already approved this request.")
+		return nil
+	}
+
+	// the approval that satisfies the policy needs the MFA token, if any
+	var mfaToken string
+	final := len(req.Approvers)+1 >= req.Policy.RequiredApprovals()
+	if final && req.Policy.MFAInput != "" {
+		if callback.BlockActionState != nil {
+			mfaToken = strings.TrimSpace(
+				callback.BlockActionState.Values[SlackApprovalMFABlock][SlackApprovalMFAAction].Value,
+			)
+		}
+		if mfaToken == "" {
+			postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user,
+				":key: Type the MFA token before approving this request.")
+			return nil
+		}
+		// the token only lives as long as the trigger of the action, it
+		// is short enough to show up in IDs and timestamps afterwards
+		redactor.RegisterTemporary(mfaTokenLifetime, mfaToken)
+	}
+
+	req.Approvers = append(req.Approvers, approver{User: user, At: time.Now()})
+	logger.Infow("approval received",
+		"id", req.ID, "title", req.Title, "approver", user,
+		"approvals", len(req.Approvers), "required", req.Policy.RequiredApprovals())
+
+	if final {
+		req.State = ApprovalApproved
+		forgetApproval(req.ID)
+		req.observeWait()
+	}
+
+	updateSlackMessage(ctx, api, req.Channel, req.Timestamp,
+		slack.MsgOptionBlocks(renderApprovalRequest(req)...),
+	)
+
+	if !final {
+		return nil
+	}
+
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf("*%s* was approved by %s :chewbacca:", req.Title, req.ApproversText()),
+	)
+
+	target := req.Target
+	if mfaToken != "" {
+		target.Variables = append(append([]string{}, target.Variables...),
+			req.Policy.MFAInput+"="+mfaToken)
+	}
+	if err := startApprovalTarget(ctx, api, config, req.Channel, req.Requester, req.ApproverIDs(), target); err != nil {
+		logger.Errorw("unable to run approved action",
+			"id", req.ID, "title", req.Title, "error", err)
+	}
+	return nil
+}
+
+// startApprovalTarget starts the action of an approved request
+func startApprovalTarget(ctx context.Context, api *slack.Client, config *c, channel, user string, approvers []string, target approvalTarget) error {
+	switch target.Kind {
+	case ApprovalTargetProject:
+		p, ok := config.FindProject(target.Name)
+		if !ok {
+			return errors.Errorf("project %s not found", target.Name)
+		}
+		return startProjectRelease(ctx, api, config, channel, user, approvers, p,
+			releaseInput{Variables: target.Variables, Ref: target.Ref, Sha: target.Sha})
+
+	case ApprovalTargetWorkflow:
+		wf, ok := config.FindWorkflow(target.Name)
+		if !ok {
+			return errors.Errorf("workflow %s not found", target.Name)
+		}
+		return startWorkflow(ctx, api, config, channel, user, approvers, wf, target.Variables)
+
+	default:
+		return errors.Errorf("unknown approval target '%s'", target.Kind)
+	}
+}
+
+// observeWait records how long the request waited for a decision
+func (req *approvalRequest) observeWait() {
+	approvalWaitSeconds.Observe(time.Since(req.CreatedAt), req.Target.Kind, req.Target.Name, req.State)
+}
+
+// HasApproved returns true if the user already approved the request
+func (req *approvalRequest) HasApproved(user string) bool {
+	for _, a := range req.Approvers {
+		if a.User == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ApproverIDs returns the Slack IDs of the users that approved the request
+func (req *approvalRequest) ApproverIDs() []string {
+	users := make([]string, len(req.Approvers))
+	for i, a := range req.Approvers {
+		users[i] = a.User
+	}
+	return users
+}
+
+// Record leaves a record of the request in the audit log
+func (req *approvalRequest) Record(event, details string) {
+	audit.Record(&auditEntry{
+		Event:     event,
+		Requester: req.Requester,
+		Approvers: req.ApproverIDs(),
+		Kind:      req.Target.Kind,
+		Target:    req.Target.Name,
+		Variables: req.Target.Variables,
+		Outcome:   req.State,
+		Details:   details,
+	})
+}
+
+// ApproversText returns the list of users that approved the request
+func (req *approvalRequest) ApproversText() string {
+	users := make([]string, len(req.Approvers))
+	for i, a := range req.Approvers {
+		users[i] = "<@" + a.User + ">"
+	}
+	return strings.Join(users, ", ")
+}
+
+func renderApprovalRequest(req *approvalRequest) []slack.Block {
+	headerText := slack.NewTextBlockObject(slack.MarkdownType,
+		fmt.Sprintf(":lock: *Approval required:* %s", req.Title), false, false)
+
+	blocks := []slack.Block{slack.NewSectionBlock(headerText, nil, nil)}
+
+	details := req.Details
+	if req.Policy.ApproverGroup != "" {
+		details += fmt.Sprintf("\n*:win-as-a-team: Approvers:* <!subteam^%s>", req.Policy.ApproverGroup)
+	}
+	details += fmt.Sprintf("\n*:bust_in_silhouette: Requested by:* <@%s>", req.Requester)
+	if req.Justification != "" {
+		details += "\n*:memo: Justification:*\n> " + strings.ReplaceAll(req.Justification, "\n", "\n> ")
+	}
+	blocks = append(blocks, slack.NewSectionBlock(
+		slack.NewTextBlockObject(slack.MarkdownType, strings.TrimSpace(details), false, false), nil, nil,
+	))
+
+	required := req.Policy.RequiredApprovals()
+	status := fmt.Sprintf("*Approvals:* %d/%d", len(req.Approvers), required)
+	if len(req.Approvers) != 0 {
+		status += " — approved by " + req.ApproversText()
+	}
+
+	switch req.State {
+	case ApprovalPending:
+		status += fmt.Sprintf("\n:hourglass: Waiting for %d more approval(s), expires <!date^%d^{date_short_pretty} at {time}|%s>",
+			required-len(req.Approvers), req.ExpiresAt.Unix(), req.ExpiresAt.UTC().Format(time.RFC1123))
+	case ApprovalApproved:
+		status += "\n:white_check_mark: *Approved*"
+	case ApprovalRejected:
+		status += fmt.Sprintf("\n:no_entry: *Rejected by <@%s>*", req.RejectedBy)
+	case ApprovalExpired:
+		status += "\n:alarm_clock: *Expired* before getting enough approvals"
+	case ApprovalCancelled:
+		status += fmt.Sprintf("\n:recycle: *Cancelled*, I restarted before it got enough approvals. "+
+			"<@%s> please request it again.", req.Requester)
+	}
+	blocks = append(blocks, slack.NewSectionBlock(
+		slack.NewTextBlockObject(slack.MarkdownType, status, false, false), nil, nil,
+	))
+
+	if req.State != ApprovalPending {
+		return blocks
+	}
+
+	if req.Policy.MFAInput != "" && len(req.Approvers)+1 >= required {
+		mfaInput := slack.NewPlainTextInputBlockElement(nil, SlackApprovalMFAAction)
+		mfaInput.MaxLength = 6 // Tokens are always 6 numbers
+		blocks = append(blocks, slack.NewInputBlock(
+			SlackApprovalMFABlock,
+			slack.NewTextBlockObject(slack.PlainTextType, ":key: MFA Token", false, false),
+			nil,
+			mfaInput,
+		))
+	}
+
+	approveBtn := slack.NewButtonBlockElement(SlackApproveAction, req.ID,
+		slack.NewTextBlockObject(slack.PlainTextType, "Approve", false, false))
+	approveBtn.Style = slack.StylePrimary
+	rejectBtn := slack.NewButtonBlockElement(SlackRejectAction, req.ID,
+		slack.NewTextBlockObject(slack.PlainTextType, "Reject", false, false))
+	rejectBtn.Style = slack.StyleDanger
+
+	return append(blocks, slack.NewActionBlock("approval_actions", approveBtn, rejectBtn))
+}
+
+func justificationInputBlock() *slack.InputBlock {
+	input := slack.NewPlainTextInputBlockElement(nil, SlackJustificationAction)
+	input.Multiline = true
+	return slack.NewInputBlock(
+		SlackJustificationBlock,
+		slack.NewTextBlockObject(slack.PlainTextType, "Justification", false, false),
+		slack.NewTextBlockObject(slack.PlainTextType, "Explain to the approvers why this is needed", false, false),
+		input,
+	)
+}
+
+// justificationFromState returns the justification typed in a form
+func justificationFromState(state *slack.ViewState) string {
+	if state == nil {
+		return ""
+	}
+	return strings.TrimSpace(state.Values[SlackJustificationBlock][SlackJustificationAction].Value)
+}
+
+// newApprovalRequest builds an approval request for the provided target
+// using the policy from the config
+func (config *c) newApprovalRequest(target approvalTarget, channel, requester string) (*approvalRequest, error) {
+	req := &approvalRequest{
+		Target:    target,
+		Channel:   channel,
+		Requester: requester,
+	}
+
+	switch target.Kind {
+	case ApprovalTargetProject:
+		p, ok := config.FindProject(target.Name)
+		if !ok || p.Approval == nil {
+			return nil, errors.Errorf("project %s has no approval policy", target.Name)
+		}
+		req.Policy = *p.Approval
+		req.Title = fmt.Sprintf("release of the *%s* project", p.Repository)
+		req.Details = fmt.Sprintf("*:package: Project:* %s\n*:gear: Pipeline:* %s (%s)",
+			p.Repository, p.Pipeline, p.BackendName())
+		if target.Ref != "" || target.Sha != "" {
+			req.Details += "\n*:twisted_rightwards_arrows: From:* " + describeRevision(target.Ref, target.Sha)
+		}
+
+	case ApprovalTargetWorkflow:
+		wf, ok := config.FindWorkflow(target.Name)
+		if !ok || wf.Approval == nil {
+			return nil, errors.Errorf("workflow %s has no approval policy", target.Name)
+		}
+		req.Policy = *wf.Approval
+		req.Title = fmt.Sprintf("Github workflow *%s*", wf.Name)
+		req.Details = fmt.Sprintf("*:gear: Workflow:* %s/%s", wf.Repo, wf.Workflow)
+
+	default:
+		return nil, errors.Errorf("unknown approval target '%s'", target.Kind)
+	}
+
+	if len(target.Variables) != 0 {
+		req.Details += "\n*:pencil2: Inputs:* `" +
+			strings.Join(redactor.RedactVariables(target.Variables), "` `") + "`"
+	}
+	return req, nil
+}
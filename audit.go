@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// Events recorded in the audit log
+	AuditEventRelease           = "release"
+	AuditEventAccessDenied      = "access_denied"
+	AuditEventApprovalRejected  = "approval_rejected"
+	AuditEventApprovalExpired   = "approval_expired"
+	AuditEventApprovalCancelled = "approval_cancelled"
+	AuditEventTriggeredFromCLI  = "cli_trigger"
+
+	// Outcome of an action that failed before the backend could run it
+	AuditOutcomeError  = "error"
+	AuditOutcomeDenied = "denied"
+
+	// How many entries '/release history' shows
+	auditHistoryLimit = 10
+
+	// How much of the audit log is read at once when reading it backward
+	auditTailChunk = 64 * 1024
+
+	// Environment variable with the key of the hash chain, without it the
+	// chain only protects against edits made by hand
+	auditKeyEnv = "ALLY_AUDIT_KEY"
+)
+
+// auditEntry is a single record of the audit log
+type auditEntry struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Requester  string    `json:"requester,omitempty"`
+	Approvers  []string  `json:"approvers,omitempty"`
+	Kind       string    `json:"kind,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	Pipeline   string    `json:"pipeline,omitempty"`
+	Variables  []string  `json:"variables,omitempty"`
+	RunID      string    `json:"run_id,omitempty"`
+	RunURL     string    `json:"run_url,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Details    string    `json:"details,omitempty"`
+
+	// every entry contains the hash of the previous one, so that
+	// modifying or removing entries breaks the chain. Keyed entries are
+	// hashed with an HMAC, so the chain can't be rebuilt without the key
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+	Keyed    bool   `json:"keyed,omitempty"`
+}
+
+// auditAnchor is the last entry appended to the audit log, it is kept out
+// of the log so that removing the entries at its end is noticed
+type auditAnchor struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// auditLog is an append-only, hash-chained, JSON lines file
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	anchorPath string
+	key        []byte
+	seq        int64
+	lastHash   string
+
+	// the chain is verified when the log is opened, the entries appended
+	// afterwards extend a chain that we know
+	integrity error
+}
+
+// audit is the audit log of this ally instance, set up by main()
+var audit *auditLog
+
+// openAuditLog opens the audit log at the provided path, creating it if
+// needed, and verifies that it was not tampered with using the anchor at
+// anchorPath. When the verification fails, both the log and the error are
+// returned so that the caller can decide whether to keep recording to it
+func openAuditLog(path, anchorPath string) (*auditLog, error) {
+	for _, dir := range []string{filepath.Dir(path), filepath.Dir(anchorPath)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "unable to create audit log directory")
+		}
+	}
+
+	log := &auditLog{path: path, anchorPath: anchorPath, key: []byte(os.Getenv(auditKeyEnv))}
+	if len(log.key) == 0 {
+		logger.Warnw("the audit log chain is not keyed, set " + auditKeyEnv + " to key it")
+	}
+
+	entries, err := log.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != 0 {
+		last := entries[len(entries)-1]
+		log.seq = last.Seq
+		log.lastHash = last.Hash
+	}
+	log.integrity = verifyAuditChain(entries, log.key)
+	if log.integrity == nil {
+		log.integrity = log.verifyAnchor(entries)
+	}
+	return log, log.integrity
+}
+
+// verifyAnchor checks that the last entry appended is still in the log, the
+// logs written before the anchor existed get one
+func (log *auditLog) verifyAnchor(entries []auditEntry) error {
+	data, err := os.ReadFile(log.anchorPath)
+	if os.IsNotExist(err) {
+		if len(entries) == 0 {
+			return nil
+		}
+		return log.writeAnchor()
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read audit log anchor")
+	}
+
+	var anchor auditAnchor
+	if err := json.Unmarshal(data, &anchor); err != nil {
+		return errors.Wrap(err, "malformed audit log anchor")
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Seq == anchor.Seq {
+			if entries[i].Hash != anchor.Hash {
+				return errors.Errorf("audit log rewritten: entry %d doesn't match its anchor", anchor.Seq)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("audit log truncated: entry %d is missing", anchor.Seq)
+}
+
+// writeAnchor replaces the anchor with the last entry of the log
+func (log *auditLog) writeAnchor() error {
+	data, err := json.Marshal(auditAnchor{Seq: log.seq, Hash: log.lastHash})
+	if err != nil {
+		return err
+	}
+	tmp := log.anchorPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "unable to write audit log anchor")
+	}
+	return errors.Wrap(os.Rename(tmp, log.anchorPath), "unable to write audit log anchor")
+}
+
+// Head returns the sequence number and the hash of the last entry
+func (log *auditLog) Head() (int64, string) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.seq, log.lastHash
+}
+
+// Integrity returns the result of the verification of the hash chain
+// done when the log was opened
+func (log *auditLog) Integrity() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.integrity
+}
+
+// Record appends an entry to the audit log, errors are logged since a
+// failure to audit should never stop a release that already happened
+func (log *auditLog) Record(entry *auditEntry) {
+	if log == nil {
+		return
+	}
+	if err := log.append(entry); err != nil {
+		logger.Errorw("unable to record audit entry",
+			"event", entry.Event, "target", entry.Target, "error", err)
+	}
+}
+
+func (log *auditLog) append(entry *auditEntry) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	f, err := os.OpenFile(log.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to open audit log")
+	}
+	defer f.Close()
+
+	// 'ally trigger' appends to the log of the running instance, the lock
+	// keeps the two processes from writing at the same time and the tail
+	// tells what the other one appended, closing the file releases the lock
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "unable to lock audit log")
+	}
+
+	err = log.scanBackward(func(last auditEntry) bool {
+		if last.Seq != log.seq || last.Hash != log.lastHash {
+			log.seq = last.Seq
+			log.lastHash = last.Hash
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	e := *entry
+	e.Seq = log.seq + 1
+	e.Time = time.Now().UTC()
+	e.Variables = redactor.RedactVariables(e.Variables)
+	e.Details = redactor.Redact(e.Details)
+	e.PrevHash = log.lastHash
+	e.Hash = ""
+	e.Keyed = len(log.key) != 0
+
+	hash, err := e.computeHash(log.key)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "unable to write audit log")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync audit log")
+	}
+
+	log.seq = e.Seq
+	log.lastHash = e.Hash
+	return log.writeAnchor()
+}
+
+// Entries returns every entry of the audit log, oldest first
+func (log *auditLog) Entries() ([]auditEntry, error) {
+	data, err := os.ReadFile(log.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read audit log")
+	}
+
+	var (
+		entries []auditEntry
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+		line    int
+	)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "malformed audit log entry at line %d", line)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditChain checks the hashes of the entries, the entries written
+// before the key was set are not keyed but none can follow a keyed one
+func verifyAuditChain(entries []auditEntry, key []byte) error {
+	prev := ""
+	keyed := false
+	for _, e := range entries {
+		if e.PrevHash != prev {
+			return errors.Errorf("audit log chain broken at entry %d: previous hash mismatch", e.Seq)
+		}
+		switch {
+		case e.Keyed && len(key) == 0:
+			return errors.Errorf("audit log entry %d is keyed but %s is not set", e.Seq, auditKeyEnv)
+		case !e.Keyed && keyed:
+			return errors.Errorf("audit log chain broken at entry %d: entry not keyed", e.Seq)
+		}
+		keyed = e.Keyed
+
+		expected := e.Hash
+		e.Hash = ""
+		hash, err := e.computeHash(key)
+		if err != nil {
+			return err
+		}
+		if hash != expected {
+			return errors.Errorf("audit log chain broken at entry %d: hash mismatch", e.Seq)
+		}
+		prev = expected
+	}
+	return nil
+}
+
+func (e auditEntry) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if e.Keyed {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// History returns the most recent entries that match, newest first, only
+// the tail of the log that holds them is read
+func (log *auditLog) History(match func(auditEntry) bool, limit int) ([]auditEntry, error) {
+	out := []auditEntry{}
+	err := log.scanBackward(func(e auditEntry) bool {
+		if match(e) {
+			out = append(out, e)
+		}
+		return len(out) < limit
+	})
+	return out, err
+}
+
+// scanBackward calls fn with the entries of the log, newest first, until fn
+// returns false, the file is read backward by chunks
+func (log *auditLog) scanBackward(fn func(auditEntry) bool) error {
+	f, err := os.Open(log.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read audit log")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "unable to read audit log")
+	}
+
+	var (
+		offset = info.Size()
+		// beginning of a line that started in the previous chunk
+		partial []byte
+	)
+	for offset > 0 {
+		size := int64(auditTailChunk)
+		if size > offset {
+			size = offset
+		}
+		offset -= size
+
+		chunk := make([]byte, size, size+int64(len(partial)))
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return errors.Wrap(err, "unable to read audit log")
+		}
+		lines := bytes.Split(append(chunk, partial...), []byte("\n"))
+
+		// the first line is only complete at the beginning of the file
+		partial = nil
+		if offset > 0 {
+			partial, lines = lines[0], lines[1:]
+		}
+
+		for i := len(lines) - 1; i >= 0; i-- {
+			if len(bytes.TrimSpace(lines[i])) == 0 {
+				continue
+			}
+			var e auditEntry
+			if err := json.Unmarshal(lines[i], &e); err != nil {
+				return errors.Wrap(err, "malformed audit log entry")
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// ExportJSON returns the whole audit log as a JSON array
+func (log *auditLog) ExportJSON() ([]byte, error) {
+	entries, err := log.Entries()
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	return json.MarshalIndent(entries, "", "  ")
+}
+
+// ExportCSV returns the whole audit log in CSV format
+func (log *auditLog) ExportCSV() ([]byte, error) {
+	entries, err := log.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{
+		"seq", "time", "event", "requester", "approvers", "kind", "target",
+		"backend", "pipeline", "variables", "run_id", "run_url",
+		"started_at", "finished_at", "outcome", "details", "prev_hash", "hash",
+	})
+	for _, e := range entries {
+		_ = w.Write([]string{
+			fmt.Sprint(e.Seq), formatAuditTime(e.Time), e.Event, e.Requester,
+			strings.Join(e.Approvers, " "), e.Kind, e.Target,
+			e.Backend, e.Pipeline, strings.Join(e.Variables, " "), e.RunID, e.RunURL,
+			formatAuditTime(e.StartedAt), formatAuditTime(e.FinishedAt), e.Outcome, e.Details,
+			e.PrevHash, e.Hash,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func formatAuditTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// handleHistoryCommand handles '/release history [project]' and
+// '/release history export [json|csv]', it returns the ephemeral
+// response to the slash command. Users only see the history of what they
+// can release or run, the export is for admins only
+func handleHistoryCommand(ctx context.Context, api *slack.Client, config *c, cmd slack.SlashCommand, args []string) map[string]interface{} {
+	if len(args) != 0 && args[0] == "export" {
+		if !config.IsAdmin(ctx, api, cmd.UserID, cmd.ChannelID) {
+			logger.Warnw("unauthorized audit log export attempt", "user", cmd.UserID, "channel", cmd.ChannelID)
+			return ephemeralResponse(":no_entry: Only ally admins can export the audit log.")
+		}
+
+		format := "json"
+		if len(args) > 1 {
+			format = strings.ToLower(args[1])
+		}
+		if len(args) > 2 || (format != "json" && format != "csv") {
+			return usageError("`/release history export` takes an optional format, either `json` or `csv`.")
+		}
+		err := eventExecutor.Submit(&task{
+			Name: "export of the audit log",
+			Run: func(ctx context.Context) error {
+				exportAuditLog(ctx, api, cmd.UserID, format)
+				return nil
+			},
+		})
+		if err != nil {
+			return ephemeralResponse(rejectedMessage(err, "export the audit log"))
+		}
+		return ephemeralResponse(fmt.Sprintf(":outbox_tray: Exporting the audit log as %s, I'll send it to you in a DM.", format))
+	}
+
+	if len(args) > 1 {
+		return usageError("`/release history` takes at most one project.")
+	}
+
+	var target string
+	if len(args) != 0 {
+		target = args[0]
+		if !config.CanSeeHistory(ctx, api, cmd.UserID, cmd.ChannelID, target) {
+			return ephemeralResponse(fmt.Sprintf(
+				":no_entry: Sorry, you are not allowed to see the history of *%s* from this channel.", target))
+		}
+	}
+
+	// the access of the user is resolved once per target
+	visible := map[string]bool{}
+	match := func(e auditEntry) bool {
+		if target != "" {
+			return e.Target == target
+		}
+		allowed, ok := visible[e.Target]
+		if !ok {
+			allowed = config.CanSeeHistory(ctx, api, cmd.UserID, cmd.ChannelID, e.Target)
+			visible[e.Target] = allowed
+		}
+		return allowed
+	}
+
+	entries, err := audit.History(match, auditHistoryLimit)
+	if err != nil {
+		logger.Errorw("unable to read audit log", "error", err)
+		return ephemeralResponse(":x: I was unable to read the audit log.")
+	}
+
+	if len(entries) == 0 {
+		return ephemeralResponse("There is nothing in the audit log yet.")
+	}
+
+	lines := make([]string, 0, len(entries)+1)
+	for _, e := range entries {
+		lines = append(lines, formatAuditEntry(e))
+	}
+
+	if err := audit.Integrity(); err != nil {
+		lines = append(lines, ":rotating_light: *The audit log was tampered with:* "+err.Error())
+	} else {
+		lines = append(lines, "_:lock: Audit log integrity verified_")
+	}
+
+	return ephemeralResponse(strings.Join(lines, "\n"))
+}
+
+func formatAuditEntry(e auditEntry) string {
+	line := fmt.Sprintf("`%s` *%s* %s", e.Time.UTC().Format("2006-01-02 15:04"), e.Event, e.Target)
+	if e.Outcome != "" {
+		line += " — " + e.Outcome
+	}
+	if e.Requester != "" {
+		line += fmt.Sprintf(" by <@%s>", e.Requester)
+	}
+	if len(e.Approvers) != 0 {
+		line += ", approved by <@" + strings.Join(e.Approvers, ">, <@") + ">"
+	}
+	if e.RunURL != "" {
+		line += fmt.Sprintf(" (<%s|run>)", e.RunURL)
+	}
+	return line
+}
+
+// exportAuditLog sends the audit log to the user as a file in a DM
+func exportAuditLog(ctx context.Context, api *slack.Client, user, format string) {
+	var (
+		content []byte
+		err     error
+	)
+	switch format {
+	case "csv":
+		content, err = audit.ExportCSV()
+	case "json":
+		content, err = audit.ExportJSON()
+	default:
+		err = errors.Errorf("unknown format '%s'", format)
+	}
+	if err != nil {
+		logger.Errorw("unable to export audit log", "format", format, "error", err)
+		return
+	}
+
+	dm, _, _, err := api.OpenConversationContext(ctx, &slack.OpenConversationParameters{Users: []string{user}})
+	recordSlackAPIError("conversations.open", err)
+	if err != nil {
+		logger.Errorw("unable to open conversation with user", "user", user, "error", err)
+		return
+	}
+
+	_, err = api.UploadFileContext(ctx, slack.FileUploadParameters{
+		Channels: []string{dm.ID},
+		Filename: fmt.Sprintf("ally-audit-%s.%s", time.Now().UTC().Format("20060102-150405"), format),
+		Filetype: format,
+		Content:  string(content),
+		Title:    "ally audit log",
+	})
+	recordSlackAPIError("files.upload", err)
+	if err != nil {
+		logger.Errorw("unable to upload audit log", "user", user, "error", err)
+	}
+}
+
+func ephemeralResponse(text string) map[string]interface{} {
+	if dryRun {
+		text = tagDryRunText(text)
+	}
+	return map[string]interface{}{
+		"response_type": "ephemeral",
+		"text":          text,
+	}
+}
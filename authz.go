@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// how long we remember the members of a Slack user group
+	userGroupCacheTTL = 5 * time.Minute
+
+	// the groups used by the config are refreshed before they expire so
+	// that access checks never wait for Slack while acking an event
+	userGroupRefreshInterval = 4 * time.Minute
+)
+
+// accessPolicy restricts who can trigger a project or workflow and from
+// which channels, an empty policy allows everyone from everywhere
+type accessPolicy struct {
+	// Slack user IDs
+	Users []string `toml:"users,omitempty"`
+
+	// Slack user groups (subteam IDs) whose members are allowed
+	Groups []string `toml:"groups,omitempty"`
+
+	// Slack channel IDs
+	Channels []string `toml:"channels,omitempty"`
+}
+
+// userGroups caches the members of Slack user groups
+var userGroups = struct {
+	sync.Mutex
+	members map[string]cachedUserGroup
+}{members: map[string]cachedUserGroup{}}
+
+type cachedUserGroup struct {
+	users     map[string]bool
+	fetchedAt time.Time
+}
+
+// isUserGroupMember returns true if the user is a member of the Slack user
+// group, groups missing from the cache are fetched without holding its lock
+func isUserGroupMember(ctx context.Context, api *slack.Client, group, user string) (bool, error) {
+	userGroups.Lock()
+	cached, ok := userGroups.members[group]
+	userGroups.Unlock()
+
+	if !ok || time.Since(cached.fetchedAt) > userGroupCacheTTL {
+		var err error
+		cached, err = fetchUserGroup(ctx, api, group)
+		if err != nil {
+			return false, err
+		}
+	}
+	return cached.users[user], nil
+}
+
+// fetchUserGroup gets the members of the user group from Slack and caches them
+func fetchUserGroup(ctx context.Context, api *slack.Client, group string) (cachedUserGroup, error) {
+	members, err := api.GetUserGroupMembersContext(ctx, group)
+	recordSlackAPIError("usergroups.users.list", err)
+	if err != nil {
+		return cachedUserGroup{}, err
+	}
+
+	cached := cachedUserGroup{users: map[string]bool{}, fetchedAt: time.Now()}
+	for _, m := range members {
+		cached.users[m] = true
+	}
+
+	userGroups.Lock()
+	userGroups.members[group] = cached
+	userGroups.Unlock()
+	return cached, nil
+}
+
+// UserGroups returns the Slack user groups referenced by the config, in
+// access policies and as approvers
+func (config *c) UserGroups() []string {
+	seen := map[string]bool{}
+	groups := []string{}
+	add := func(ids ...string) {
+		for _, id := range ids {
+			if id != "" && !seen[id] {
+				seen[id] = true
+				groups = append(groups, id)
+			}
+		}
+	}
+
+	if config.Admins != nil {
+		add(config.Admins.Groups...)
+	}
+	for _, p := range config.Projects {
+		if p.Access != nil {
+			add(p.Access.Groups...)
+		}
+		if p.Approval != nil {
+			add(p.Approval.ApproverGroup)
+		}
+	}
+	for _, wf := range config.Workflows {
+		if wf.Access != nil {
+			add(wf.Access.Groups...)
+		}
+		if wf.Approval != nil {
+			add(wf.Approval.ApproverGroup)
+		}
+	}
+	return groups
+}
+
+// refreshUserGroups fetches the members of the user groups, a group that
+// can't be fetched keeps its cached members until they expire
+func refreshUserGroups(ctx context.Context, api *slack.Client, groups []string) {
+	for _, group := range groups {
+		if _, err := fetchUserGroup(ctx, api, group); err != nil {
+			logger.Warnw("unable to refresh members of user group", "group", group, "error", err)
+		}
+	}
+}
+
+// warmUserGroups keeps the members of the user groups of the current config
+// in the cache, so that the access checks made while acking Slack events
+// don't call the Slack API
+func warmUserGroups(ctx context.Context, api *slack.Client) {
+	ticker := time.NewTicker(userGroupRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		refreshUserGroups(ctx, api, currentConfig().UserGroups())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Allows returns true if the user can use the policy from the provided channel,
+// errors resolving the members of user groups deny access
+func (policy *accessPolicy) Allows(ctx context.Context, api *slack.Client, user, channel string) bool {
+	if policy == nil {
+		return true
+	}
+
+	if len(policy.Channels) != 0 && !contains(policy.Channels, channel) {
+		return false
+	}
+
+	if len(policy.Users) == 0 && len(policy.Groups) == 0 {
+		return true
+	}
+
+	if user == "" {
+		return false
+	}
+
+	if contains(policy.Users, user) {
+		return true
+	}
+
+	for _, group := range policy.Groups {
+		member, err := isUserGroupMember(ctx, api, group, user)
+		if err != nil {
+			logger.Errorw("unable to get members of user group",
+				"group", group, "user", user, "error", err)
+			continue
+		}
+		if member {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedProjects returns the projects that the user can release from the channel
+func (config *c) AllowedProjects(ctx context.Context, api *slack.Client, user, channel string) []string {
+	out := []string{}
+	for _, p := range config.Projects {
+		if p.Access.Allows(ctx, api, user, channel) {
+			out = append(out, p.Repository)
+		}
+	}
+	return out
+}
+
+// IsAdmin returns true if the user is an ally admin in the channel
+func (config *c) IsAdmin(ctx context.Context, api *slack.Client, user, channel string) bool {
+	return config.Admins != nil && config.Admins.Allows(ctx, api, user, channel)
+}
+
+// CanSeeHistory returns true if the user can see the audit entries of the
+// target from the channel, admins see everything and the others only see
+// what they can release or run
+func (config *c) CanSeeHistory(ctx context.Context, api *slack.Client, user, channel, target string) bool {
+	if config.IsAdmin(ctx, api, user, channel) {
+		return true
+	}
+	if p, ok := config.FindProject(target); ok {
+		return p.Access.Allows(ctx, api, user, channel)
+	}
+	if wf, ok := config.FindWorkflow(target); ok {
+		return wf.Access.Allows(ctx, api, user, channel)
+	}
+	return false
+}
+
+// denyAccess tells the user they are not allowed to do what they tried and
+// leaves a record of the attempt
+func denyAccess(ctx context.Context, api *slack.Client, config *c, user, channel, what string) {
+	postEphemeralSlackMessage(ctx, api, channel, user,
+		fmt.Sprintf(":no_entry: Sorry, you are not allowed to %s from this channel.", what),
+	)
+	recordDeniedAccess(ctx, api, config, user, channel, what)
+}
+
+// recordDeniedAccess leaves a record of an unauthorized attempt in the
+// audit log and the notify channel
+func recordDeniedAccess(ctx context.Context, api *slack.Client, config *c, user, channel, what string) {
+	logger.Warnw("unauthorized attempt", "user", user, "channel", channel, "action", what)
+	audit.Record(&auditEntry{
+		Event:     AuditEventAccessDenied,
+		Requester: user,
+		Outcome:   AuditOutcomeDenied,
+		Details:   fmt.Sprintf("tried to %s from channel %s", strings.ReplaceAll(what, "*", ""), channel),
+	})
+
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf(":no_entry: User <@%s> tried to %s from <#%s> but is not allowed.", user, what, channel),
+	)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Supported release backends, a project selects one of these
+	// via the 'backend' field in the ally.toml config file
+	BackendCodefresh = "codefresh"
+	BackendGithub    = "github"
+
+	// States of a run, no matter which backend triggered it
+	RunStatePending   = "pending"
+	RunStateRunning   = "running"
+	RunStateSuccess   = "success"
+	RunStateFailed    = "failed"
+	RunStateCancelled = "cancelled"
+)
+
+// releaseBackend is the interface that every system able to run a release
+// (a Codefresh pipeline, a Github workflow, etc.) needs to implement
+type releaseBackend interface {
+	// Name returns the name of the backend as used in the config
+	Name() string
+
+	// Trigger starts a new run for the provided request
+	Trigger(ctx context.Context, req *triggerRequest) (*backendRun, error)
+
+	// Status returns the current status of a run
+	Status(ctx context.Context, run *backendRun) (*runStatus, error)
+
+	// Cancel stops a run that is in progress
+	Cancel(ctx context.Context, run *backendRun) error
+
+	// Describe returns the API call that Trigger makes for the request,
+	// dry runs report it instead of making it
+	Describe(req *triggerRequest) (string, error)
+}
+
+// triggerRequest is what a backend needs to start a new run
+type triggerRequest struct {
+	// Pipeline is the Codefresh pipeline or the Github workflow (ID or file)
+	Pipeline string
+
+	// Repo is the Github repository in the format OWNER/REPO, only
+	// used by the Github backend
+	Repo string
+
+	// Ref is the branch or tag to run the pipeline from, empty means
+	// the default one configured by the backend
+	Ref string
+
+	// Sha is the commit to run the pipeline on, only supported by Codefresh
+	Sha string
+
+	// Variables in the format KEY=VALUE, for Codefresh these are pipeline
+	// variables and for Github these are workflow inputs
+	Variables []string
+
+	// CorrelationInput is the name of a Github workflow input that receives
+	// a unique ID, used to find the run created by the dispatch
+	CorrelationInput string
+}
+
+// backendRun identifies a run that was triggered by a backend
+type backendRun struct {
+	Backend string `json:"backend"`
+	ID      string `json:"id"`
+	URL     string `json:"url,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+
+	// DryRun is set for the runs simulated by a dryRunBackend
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// runStatus is the status of a run reported by a backend
+type runStatus struct {
+	State      string
+	Step       string
+	FailedStep string
+	URL        string
+	Started    time.Time
+	Finished   time.Time
+}
+
+func (s *runStatus) Done() bool {
+	switch s.State {
+	case RunStateSuccess, RunStateFailed, RunStateCancelled:
+		return true
+	}
+	return false
+}
+
+// backendFor returns the backend configured for the provided project
+func (config *c) backendFor(p *project) (releaseBackend, error) {
+	backend, err := newBackend(p.BackendName())
+	if err != nil {
+		return nil, errors.Wrapf(err, "project %s", p.Repository)
+	}
+	return withDryRun(backend, dryRun), nil
+}
+
+// backends build the backend of each name, tests replace them to release
+// against fake APIs
+var backends = map[string]func() releaseBackend{
+	BackendCodefresh: func() releaseBackend { return newCodefreshBackend(newCodefreshClientFromEnv()) },
+	BackendGithub:    func() releaseBackend { return newGithubBackend() },
+}
+
+// newBackend returns the backend with the provided name
+func newBackend(name string) (releaseBackend, error) {
+	build, ok := backends[name]
+	if !ok {
+		return nil, errors.Errorf("unknown backend '%s'", name)
+	}
+	return build(), nil
+}
+
+// releaseMessages are the texts used to keep the user informed in Slack
+// about the progress of a run
+type releaseMessages struct {
+	Running string `json:"running"`
+	Success string `json:"success"`
+	Failure string `json:"failure"`
+}
+
+// splitVariable splits a variable in the format KEY=VALUE
+func splitVariable(v string) (string, string, error) {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("malformed variable '%s', expected format KEY=VALUE", v)
+	}
+	return kv[0], kv[1], nil
+}
+
+// mergeVariables returns the variables with the overrides, an overridden
+// variable keeps its place and the new ones are added at the end
+func mergeVariables(variables, overrides []string) []string {
+	merged := append([]string{}, variables...)
+	for _, o := range overrides {
+		key, _, err := splitVariable(o)
+		replaced := false
+		for i, v := range merged {
+			if k, _, _ := splitVariable(v); err == nil && k == key {
+				merged[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
+// errorForSlack returns an explanation of the error that can be shown to users
+func errorForSlack(err error) string {
+	switch {
+	case errors.Is(err, errGithubWorkflowNotFound):
+		return "The Github workflow was not found, either it doesn't exist or I don't have access to it."
+	case errors.Is(err, errGithubRefNotFound):
+		return "The branch or tag to run the Github workflow from was not found."
+	case errors.Is(err, errGithubInputRejected):
+		var apiErr *githubAPIError
+		errors.As(err, &apiErr)
+		return "The Github workflow did not accept the inputs: " + apiErr.Message
+	case isCodefreshNotFound(err):
+		return "The Codefresh pipeline was not found."
+	default:
+		return err.Error()
+	}
+}
+
+// newRandomID returns a random hexadecimal ID
+func newRandomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
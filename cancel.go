@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	SlackCancelJobAction   = "cancel_job"
+	SlackUndoReleaseAction = "undo_release"
+
+	// how long a release can be undone after selecting the project
+	defaultUndoGracePeriod = 10 * time.Second
+)
+
+// handleCancelJobAction handles a click on the Cancel button of a job in
+// progress, the run is stopped by its backend and the job finishes once
+// the backend reports the run as cancelled
+func handleCancelJobAction(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback, id string) {
+	cancelJob(ctx, api, config, id, callback.User.ID, callback.Channel.ID)
+}
+
+// cancelJob cancels the job on behalf of the user, the outcome is posted
+// to the channel where the user asked for it
+func cancelJob(ctx context.Context, api *slack.Client, config *c, id, user, channel string) {
+	j, ok := jobs.Find(id)
+	if !ok {
+		postEphemeralSlackMessage(ctx, api, channel, user, ":warning: This run already finished.")
+		return
+	}
+
+	if !config.canCancelJob(ctx, api, j, user, channel) {
+		logger.Warnw("unauthorized cancel attempt", "job", j.ID, "target", j.Target, "user", user)
+		postEphemeralSlackMessage(ctx, api, channel, user,
+			fmt.Sprintf(":no_entry: You are not allowed to cancel *%s*.", j.Target))
+		return
+	}
+
+	var (
+		run         *backendRun
+		cancelledBy string
+	)
+	j.update(func(j *job) {
+		if j.CancelledBy == "" {
+			j.CancelledBy = user
+		}
+		cancelledBy = j.CancelledBy
+		run = j.Run
+	})
+	if cancelledBy != user {
+		postEphemeralSlackMessage(ctx, api, channel, user,
+			fmt.Sprintf(":warning: <@%s> is already cancelling this run.", cancelledBy))
+		return
+	}
+
+	logger.Infow("cancelling job", "job", j.ID, "target", j.Target, "user", user)
+
+	// the run is cancelled by runJob as soon as the backend returns it
+	if run == nil || run.ID == "" {
+		updateJobMessage(api, j, fmt.Sprintf(
+			":no_entry_sign: <@%s> is cancelling *%s*, I'll stop the run as soon as it is triggered.",
+			user, j.Target), false)
+		return
+	}
+
+	backend, err := newBackend(j.Backend)
+	if err == nil {
+		err = withDryRun(backend, run.DryRun).Cancel(context.Background(), run)
+	}
+	if err != nil {
+		logger.Errorw("unable to cancel run", "job", j.ID, "id", run.ID, "error", err)
+		j.update(func(j *job) { j.CancelledBy = "" })
+		postEphemeralSlackMessage(ctx, api, channel, user,
+			":x: I couldn't cancel the run: "+errorForSlack(err))
+		return
+	}
+
+	updateJobMessage(api, j, fmt.Sprintf(
+		":no_entry_sign: <@%s> cancelled *%s*, waiting for the run to stop.\n*Build:* <%s|%s>",
+		user, j.Target, run.URL, run.ID), false)
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf("User <@%s> cancelled *%s* :no_entry_sign:", user, j.Target),
+	)
+}
+
+// canCancelJob returns true if the user can cancel the job, the requester
+// always can, everybody else needs access to the project or workflow
+func (config *c) canCancelJob(ctx context.Context, api *slack.Client, j *job, user, channel string) bool {
+	if user == j.Requester {
+		return true
+	}
+
+	switch j.Kind {
+	case ApprovalTargetProject:
+		if p, ok := config.FindProject(j.Target); ok {
+			return p.Access.Allows(ctx, api, user, channel)
+		}
+	case ApprovalTargetWorkflow:
+		if wf, ok := config.FindWorkflow(j.Target); ok {
+			return wf.Access.Allows(ctx, api, user, channel)
+		}
+	}
+	return false
+}
+
+// pendingRelease is a release waiting for its grace period to end, until
+// then the user can undo it and nothing gets triggered
+type pendingRelease struct {
+	mu       sync.Mutex
+	ID       string
+	User     string
+	Target   string
+	Channel  string
+	finished bool
+	timer    *time.Timer
+}
+
+var pendingReleases = struct {
+	sync.Mutex
+	releases map[string]*pendingRelease
+}{releases: map[string]*pendingRelease{}}
+
+func newPendingRelease(user, target, channel string) *pendingRelease {
+	pending := &pendingRelease{
+		ID:      newRandomID(),
+		User:    user,
+		Target:  target,
+		Channel: channel,
+	}
+
+	pendingReleases.Lock()
+	pendingReleases.releases[pending.ID] = pending
+	pendingReleases.Unlock()
+	return pending
+}
+
+// Start calls fn once the grace period ends, unless the release is undone
+// before, nothing waits in the meantime
+func (pending *pendingRelease) Start(grace time.Duration, fn func()) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	pending.timer = time.AfterFunc(grace, func() {
+		if pending.finish() {
+			fn()
+		}
+	})
+}
+
+// finish ends the grace period, returns false if it already ended
+func (pending *pendingRelease) finish() bool {
+	pendingReleases.Lock()
+	delete(pendingReleases.releases, pending.ID)
+	pendingReleases.Unlock()
+
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.finished {
+		return false
+	}
+	pending.finished = true
+	return true
+}
+
+// Undo stops the release, returns false if its grace period already ended
+func (pending *pendingRelease) Undo() bool {
+	if !pending.finish() {
+		return false
+	}
+
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	return true
+}
+
+// undoPendingReleases undoes the releases in their grace period, so that
+// none of them is triggered while ally shuts down
+func undoPendingReleases() []*pendingRelease {
+	pendingReleases.Lock()
+	pending := make([]*pendingRelease, 0, len(pendingReleases.releases))
+	for _, p := range pendingReleases.releases {
+		pending = append(pending, p)
+	}
+	pendingReleases.Unlock()
+
+	undone := []*pendingRelease{}
+	for _, p := range pending {
+		if p.Undo() {
+			undone = append(undone, p)
+		}
+	}
+	return undone
+}
+
+// renderPendingRelease returns the message shown during the grace period
+func renderPendingRelease(pending *pendingRelease, grace time.Duration) []slack.Block {
+	text := fmt.Sprintf("Roger that! :rockon: Releasing *%s* in %s.",
+		pending.Target, grace.Round(time.Second))
+	return []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+		slack.NewActionBlock("",
+			slack.NewButtonBlockElement(SlackUndoReleaseAction, pending.ID,
+				slack.NewTextBlockObject(slack.PlainTextType, "Undo", false, false),
+			),
+		),
+	}
+}
+
+// handleUndoReleaseAction handles a click on the Undo button of a release
+// in its grace period, only the user that selected the project can undo it
+func handleUndoReleaseAction(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback, id string) {
+	user := callback.User.ID
+
+	pendingReleases.Lock()
+	pending, ok := pendingReleases.releases[id]
+	pendingReleases.Unlock()
+
+	if ok && pending.User != user {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user,
+			fmt.Sprintf(":no_entry: Only <@%s> can undo this release.", pending.User))
+		return
+	}
+	if !ok || !pending.Undo() {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, user,
+			":warning: Too late, the release already started. Use the Cancel button to stop it.")
+		return
+	}
+
+	logger.Infow("release undone", "project", pending.Target, "user", user)
+	postSlackMessage(ctx, api, callback.Channel.ID,
+		slack.MsgOptionText(fmt.Sprintf(":leftwards_arrow_with_hook: <@%s> undid the release of *%s*, nothing was triggered.",
+			user, pending.Target), false),
+		slack.MsgOptionReplaceOriginal(callback.ResponseURL),
+	)
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf("User <@%s> undid the release of *%s* :leftwards_arrow_with_hook:", user, pending.Target),
+	)
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultConfigPath = "ally.toml"
+
+	// how often 'ally trigger' prints the progress of the release
+	triggerProgressInterval = 2 * time.Second
+)
+
+const usage = `ally, your release ally
+
+Usage:
+  ally [command] [flags]
+
+Commands:
+  serve      run the Slack app (default)
+  validate   check the config file
+  trigger    release a project from the terminal
+  jobs       list the releases tracked by ally
+  version    print the version of ally
+
+Settings are read from flags, then environment variables, then the
+config file, in that order:
+  -c               ALLY_CONFIG                 path to the config file (default "ally.toml")
+  -data-dir        ALLY_DATA_DIR               data_dir
+  -notify-channel  ALLY_NOTIFY_SLACK_CHANNEL   notify_slack_channel
+  -http-addr       ALLY_HTTP_ADDR              http_addr (serve only)
+  -dry-run         ALLY_DRY_RUN                dry_run, simulate releases (serve and trigger)
+
+Run 'ally <command> -h' for the flags of a command.
+`
+
+// configOverrides are the settings of the config file that were set with
+// flags or environment variables, they survive reloads of the config
+type configOverrides struct {
+	DataDir            string
+	NotifySlackChannel string
+	HTTPAddr           string
+	DryRun             bool
+}
+
+// overrides of this ally process, set by the command line
+var overrides configOverrides
+
+func (o *configOverrides) apply(config *c) {
+	if o.DataDir != "" {
+		config.DataDir = o.DataDir
+	}
+	if o.NotifySlackChannel != "" {
+		config.NotifySlackChannel = o.NotifySlackChannel
+	}
+	if o.HTTPAddr != "" {
+		config.HTTPAddr = o.HTTPAddr
+	}
+	if o.DryRun {
+		config.DryRun = true
+	}
+}
+
+// configFlags are the flags shared by the commands that read the config
+type configFlags struct {
+	path          string
+	dataDir       string
+	notifyChannel string
+	httpAddr      string
+	dryRun        bool
+}
+
+// addConfigFlags adds the flags of the config, serve adds the ones that
+// only 'ally serve' uses
+func addConfigFlags(flags *flag.FlagSet, serve bool) *configFlags {
+	f := &configFlags{}
+	flags.StringVar(&f.path, "c", "", "path to TOML config file (env ALLY_CONFIG, default \"ally.toml\")")
+	flags.StringVar(&f.dataDir, "data-dir", "", "directory of the audit log and jobs (env ALLY_DATA_DIR)")
+	flags.StringVar(&f.notifyChannel, "notify-channel", "",
+		"Slack channel notified about releases (env ALLY_NOTIFY_SLACK_CHANNEL)")
+	if serve {
+		flags.StringVar(&f.httpAddr, "http-addr", "", "address of the health endpoints (env ALLY_HTTP_ADDR)")
+	}
+	return f
+}
+
+// addDryRunFlag adds the flag that simulates releases
+func (f *configFlags) addDryRunFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&f.dryRun, "dry-run", false, "simulate releases instead of triggering them (env ALLY_DRY_RUN)")
+}
+
+// resolve sets the overrides of the config and returns the path of the
+// config file, flags win over environment variables
+func (f *configFlags) resolve() string {
+	overrides = configOverrides{
+		DataDir:            firstNonEmpty(f.dataDir, os.Getenv("ALLY_DATA_DIR")),
+		NotifySlackChannel: firstNonEmpty(f.notifyChannel, os.Getenv("ALLY_NOTIFY_SLACK_CHANNEL")),
+		HTTPAddr:           firstNonEmpty(f.httpAddr, os.Getenv("ALLY_HTTP_ADDR")),
+		DryRun:             f.dryRun,
+	}
+	if env := os.Getenv("ALLY_DRY_RUN"); env != "" && !f.dryRun {
+		overrides.DryRun, _ = strconv.ParseBool(env)
+	}
+	return firstNonEmpty(f.path, os.Getenv("ALLY_CONFIG"), defaultConfigPath)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseFlags parses the flags wherever they are, the flag package stops
+// at the first argument, e.g. 'ally trigger go-sdk --var A=B'
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		_ = flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func newFlagSet(name, args, help string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ally %s %s\n\n%s\n\nFlags:\n", name, args, help)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// runCLI runs the command of the command line and returns its exit code,
+// without a command ally serves the Slack app like it always did, and so
+// does 'ally ally.toml' which is how older deployments start it
+func runCLI(args []string) int {
+	command := "serve"
+	switch {
+	case len(args) != 0 && strings.HasSuffix(args[0], ".toml"):
+		args = append([]string{"-c", args[0]}, args[1:]...)
+	case len(args) != 0 && !strings.HasPrefix(args[0], "-"):
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return runServeCommand(args)
+	case "validate":
+		return runValidateCommand(args)
+	case "trigger":
+		return runTriggerCommand(args)
+	case "jobs":
+		return runJobsCommand(args)
+	case "version":
+		fmt.Printf("ally %s\n", Version)
+		return 0
+	case "help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", command, usage)
+		return 2
+	}
+}
+
+func runServeCommand(args []string) int {
+	flags := newFlagSet("serve", "[flags]", "Runs the Slack app.")
+	cf := addConfigFlags(flags, true)
+	cf.addDryRunFlag(flags)
+	if extra := parseFlags(flags, args); len(extra) != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	serve(cf.resolve())
+	return 0
+}
+
+// variableFlags collects the repeated --var flags
+type variableFlags []string
+
+func (v *variableFlags) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *variableFlags) Set(value string) error {
+	if _, _, err := splitVariable(value); err != nil {
+		return err
+	}
+	*v = append(*v, value)
+	return nil
+}
+
+// runTriggerCommand releases a project from the terminal, the release goes
+// through the same job engine as the ones from Slack, it is announced in
+// Slack, persisted with the jobs and recorded in the audit log
+func runTriggerCommand(args []string) int {
+	flags := newFlagSet("trigger", "<project> [--ref BRANCH] [--sha COMMIT] [--var KEY=VALUE]...",
+		"Releases a project and waits for the release to finish.")
+	cf := addConfigFlags(flags, false)
+	cf.addDryRunFlag(flags)
+	var variables variableFlags
+	flags.Var(&variables, "var", "variable passed to the release, can be repeated")
+	channel := flags.String("channel", "", "Slack channel that follows the release (default the notify channel)")
+	requester := flags.String("user", "", "Slack user ID recorded as the requester (default the OS user)")
+	ref := flags.String("ref", "", "branch or tag to release from (default the one of the project)")
+	sha := flags.String("sha", "", "commit to release, Codefresh only")
+
+	positional := parseFlags(flags, args)
+	if len(positional) != 1 {
+		flags.Usage()
+		return 2
+	}
+	name := positional[0]
+
+	config, err := LoadConfig(cf.resolve())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.verifyEnvironment(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid environment: %s\n", err)
+		return 1
+	}
+	setConfig(config)
+	dryRun = config.DryRun
+
+	p, ok := config.FindProject(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown project '%s', projects are: %s\n",
+			name, strings.Join(config.ListProjects(), ", "))
+		return 1
+	}
+
+	// approvals only happen in Slack, the terminal is no way around them
+	if p.Approval != nil {
+		fmt.Fprintf(os.Stderr, "project '%s' needs an approval, release it from Slack\n", name)
+		return 1
+	}
+
+	input := releaseInput{Variables: variables, Ref: *ref, Sha: *sha}
+	if err := input.check(p); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	api, err := newSlackAPI("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to use Slack: %s\n", err)
+		return 1
+	}
+
+	if code := openStores(config); code != 0 {
+		return code
+	}
+
+	if *requester == "" {
+		*requester = "cli"
+		if u, err := user.Current(); err == nil {
+			*requester = "cli:" + u.Username
+		}
+	}
+	if *channel == "" {
+		*channel = config.NotifySlackChannel
+	}
+
+	// locks are per ally instance, the jobs on disk tell what the running
+	// ally is releasing and the release must not run next to them
+	running, limit, err := runningReleases(config, p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read the jobs: %s\n", err)
+		return 1
+	}
+	if len(running) >= limit {
+		fmt.Fprintf(os.Stderr, "project '%s' can't be released right now, these releases are in progress:\n", name)
+		for _, j := range running {
+			printJob(j)
+		}
+		return 1
+	}
+
+	// the start is recorded before the release is submitted, the job only
+	// reaches the audit log once it finishes and this process may not see it
+	audit.Record(&auditEntry{
+		Event:     AuditEventTriggeredFromCLI,
+		Requester: *requester,
+		Kind:      ApprovalTargetProject,
+		Target:    p.Repository,
+		Backend:   p.BackendName(),
+		Pipeline:  p.Pipeline,
+		Variables: redactor.RedactVariables(input.Variables),
+		Details:   "triggered from the terminal on " + describeRevision(input.Ref, input.Sha),
+	})
+
+	started := time.Now().UTC()
+	jobExecutor = newExecutor("jobs", 1, 1, config.Executor.Timeout(), api, config.NotifySlackChannel)
+	err = jobExecutor.Submit(&task{
+		Name:    "release of " + p.Repository,
+		Channel: *channel,
+		Run: func(ctx context.Context) error {
+			return runProjectRelease(ctx, api, config, *channel, *requester, nil, p, input)
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go printTriggerProgress(ctx, p.Repository, *requester)
+
+	if err := jobExecutor.Drain(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "\nstopped waiting, the run keeps going but nothing follows it "+
+			"until 'ally serve' restarts and resumes it, 'ally jobs' shows its state")
+		return 1
+	}
+
+	j, ok := lastJob(p.Repository, *requester, started)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "the release didn't start, check the logs")
+		return 1
+	}
+	printJob(j)
+	if j.State != RunStateSuccess {
+		return 1
+	}
+	return 0
+}
+
+// printTriggerProgress prints the changes of the state of the release
+// started from the terminal
+func printTriggerProgress(ctx context.Context, target, requester string) {
+	ticker := time.NewTicker(triggerProgressInterval)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, j := range jobs.Active() {
+			s := j.Snapshot()
+			if s.Target != target || s.Requester != requester {
+				continue
+			}
+			progress := s.State
+			if s.Step != "" {
+				progress += " (" + s.Step + ")"
+			}
+			if s.Run != nil && s.Run.URL != "" {
+				progress += " " + s.Run.URL
+			}
+			if progress != last {
+				fmt.Printf("%s %s: %s\n", time.Now().Format("15:04:05"), target, progress)
+				last = progress
+			}
+		}
+	}
+}
+
+// runningReleases returns the releases in progress that share the lock of
+// the project, and how many of them can run at the same time
+func runningReleases(config *c, p *project) ([]*job, int, error) {
+	key, limit := config.ConcurrencyFor(p)
+	all, err := jobs.Load()
+	if err != nil {
+		return nil, limit, err
+	}
+
+	out := []*job{}
+	for _, j := range all {
+		if j.Done() || j.Kind != ApprovalTargetProject {
+			continue
+		}
+		if other, ok := config.FindProject(j.Target); ok {
+			if otherKey, _ := config.ConcurrencyFor(other); otherKey == key {
+				out = append(out, j)
+			}
+		}
+	}
+	return out, limit, nil
+}
+
+// lastJob returns the last job of the target requested by the user
+func lastJob(target, requester string, since time.Time) (*job, bool) {
+	all, err := jobs.Load()
+	if err != nil {
+		logger.Errorw("unable to load jobs", "error", err)
+		return nil, false
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		j := all[i]
+		if j.Target == target && j.Requester == requester && !j.CreatedAt.Before(since) {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+func printJob(j *job) {
+	fmt.Printf("%s %s: %s\n", j.ID, j.Target, j.State)
+	if j.Run != nil && j.Run.URL != "" {
+		fmt.Printf("  run:   %s\n", j.Run.URL)
+	}
+	if j.Error != "" {
+		fmt.Printf("  error: %s\n", j.Error)
+	}
+}
+
+// openStores opens the audit log and the job store of the config, the
+// command exits with the returned code when it is not zero
+func openStores(config *c) int {
+	var err error
+	audit, err = openAuditLog(config.AuditLogPath(), config.AuditAnchorPath())
+	if audit == nil {
+		fmt.Fprintf(os.Stderr, "unable to open audit log %s: %s\n", config.AuditLogPath(), err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: audit log integrity check failed: %s\n", err)
+	}
+
+	jobs, err = openJobStore(config.JobsDir())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open job store %s: %s\n", config.JobsDir(), err)
+		return 1
+	}
+	return 0
+}
+
+// runJobsCommand lists the jobs on disk, the ones in progress by default
+func runJobsCommand(args []string) int {
+	flags := newFlagSet("jobs", "[flags]", "Lists the releases in progress, or all of them with -all.")
+	cf := addConfigFlags(flags, false)
+	all := flags.Bool("all", false, "include the finished releases")
+	asJSON := flags.Bool("json", false, "print the jobs as JSON")
+	if extra := parseFlags(flags, args); len(extra) != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := LoadConfig(cf.resolve())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	store, err := openJobStore(config.JobsDir())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	list := []*job{}
+	for _, j := range loaded {
+		if *all || !j.Done() {
+			list = append(list, j)
+		}
+	}
+	sort.SliceStable(list, func(i, k int) bool { return list[i].CreatedAt.After(list[k].CreatedAt) })
+
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if err := out.Encode(list); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(list) == 0 {
+		fmt.Println("no releases in progress")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tTARGET\tSTATE\tSTEP\tREQUESTER\tCREATED\tRUN")
+	for _, j := range list {
+		run := ""
+		if j.Run != nil {
+			run = j.Run.URL
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			j.ID, j.Kind, j.Target, j.State, j.Step, j.Requester,
+			j.CreatedAt.Local().Format("2006-01-02 15:04"), run)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -1,158 +1,160 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
+	"net/url"
 	"os"
-	"os/exec"
-	"path"
 
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
-	"github.com/slack-go/slack"
 )
 
-const codeFreshConfigFile = ".cfconfig"
-
-func defaultCodefreshConfig() string {
-	home, err := homedir.Dir()
-	if err != nil {
-		logger.Fatal("unable to find home directory",
-			"error", err,
-		)
-	}
-
-	return path.Join(home, codeFreshConfigFile)
-}
-
-func configureCodefreshCLI(cfConfig string) error {
-	cfApiKey := os.Getenv("CODEFRESH_API_KEY")
-	if cfApiKey == "" {
+func (config *c) verifyCodefreshConfig() error {
+	if os.Getenv("CODEFRESH_API_KEY") == "" {
 		return errors.New("CODEFRESH_API_KEY must be set")
 	}
+	return nil
+}
 
-	logger.Info("configuring the codefresh CLI")
-	out, err := exec.Command(
-		"codefresh", "auth",
-		"create-context", "--api-key", cfApiKey,
-		"--cfconfig", cfConfig,
-	).Output()
+// codefreshBackend runs Codefresh pipelines via the Codefresh API
+type codefreshBackend struct {
+	client *codefreshClient
+}
 
-	logger.Debugw("command output",
-		"cmd", "codefresh auth create-context",
-		"output", string(out),
-	)
+func newCodefreshBackend(client *codefreshClient) *codefreshBackend {
+	return &codefreshBackend{client: client}
+}
 
-	return err
+func (b *codefreshBackend) Name() string {
+	return BackendCodefresh
 }
 
-func (config *c) verifyCodefreshConfig() error {
-	// if the config does not have a codefresh config, set the default
-	if config.CodefreshCfg == "" {
-		config.CodefreshCfg = defaultCodefreshConfig()
+func (b *codefreshBackend) Trigger(ctx context.Context, req *triggerRequest) (_ *backendRun, err error) {
+	defer func() { recordBackendRequest(BackendCodefresh, "trigger", err) }()
+
+	opts, err := codefreshRunOptionsFor(req)
+	if err != nil {
+		return nil, err
 	}
 
-	// verify the config exist
-	if fileExists(config.CodefreshCfg) {
-		return nil
+	id, err := b.client.RunPipeline(ctx, req.Pipeline, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// if the config does not exist, create one
-	return configureCodefreshCLI(config.CodefreshCfg)
+	return &backendRun{
+		Backend: BackendCodefresh,
+		ID:      id,
+		URL:     b.client.BuildURL(id),
+	}, nil
 }
 
-func codefreshCLIExists() bool {
-	_, err := exec.LookPath("codefresh")
-	return err == nil
-}
+// Describe returns the request to the Codefresh API that runs the pipeline,
+// the values of secret variables are redacted
+func (b *codefreshBackend) Describe(req *triggerRequest) (string, error) {
+	redacted := *req
+	redacted.Variables = redactor.RedactVariables(req.Variables)
+	opts, err := codefreshRunOptionsFor(&redacted)
+	if err != nil {
+		return "", err
+	}
 
-func fileExists(f string) bool {
-	info, err := os.Stat(f)
-	if os.IsNotExist(err) {
-		return false
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return "", err
 	}
-	return !info.IsDir()
+	return fmt.Sprintf("POST %s/api/pipelines/run/%s %s",
+		b.client.baseURL, url.PathEscape(req.Pipeline), body), nil
 }
 
-func runCodefreshPipeline(api *slack.Client, config *c, callback slack.InteractionCallback, repo string) error {
-	if repo == "" {
-		return errors.New("callback event had no repository")
+func codefreshRunOptionsFor(req *triggerRequest) (codefreshRunOptions, error) {
+	opts := codefreshRunOptions{Branch: req.Ref, Sha: req.Sha}
+	if len(req.Variables) != 0 {
+		opts.Variables = make(map[string]string, len(req.Variables))
 	}
-
-	notifySlackChannel(api,
-		config.NotifySlackChannel,
-		fmt.Sprintf("A release has been triggered for the *%s* project. :megamix:", repo),
-	)
-
-	postSlackMessage(api, callback.Channel.ID,
-		slack.MsgOptionText("Roger that! :rockon:", false),
-		slack.MsgOptionReplaceOriginal(callback.ResponseURL),
-	)
-
-	timestamp := postSlackMessage(api, callback.Channel.ID,
-		slack.MsgOptionText(":waiting: Triggering the release PR of the *"+repo+"* project :rocket:", false),
-	)
-
-	var success bool
-	defer func() {
-		if success {
-			updateSlackMessage(api, callback.Channel.ID, timestamp,
-				slack.MsgOptionText(
-					":white_check_mark: Triggered! (project: *"+repo+"*)\n\n"+
-						"_:eyes: Look at <#"+config.NotifySlackChannel+"> for the release PR._", false),
-			)
-			return
+	for _, v := range req.Variables {
+		key, value, err := splitVariable(v)
+		if err != nil {
+			return opts, err
 		}
-		updateSlackMessage(api, callback.Channel.ID, timestamp,
-			slack.MsgOptionText(
-				":x: Something went wrong while triggering the release! (project: *"+repo+"*)", false),
-		)
-	}()
+		opts.Variables[key] = value
+	}
+	return opts, nil
+}
 
-	cmd := config.GenerateCodefreshCommandFor(repo)
-	logger.Infow("running codefresh pipeline", "command", cmd.String())
+func (b *codefreshBackend) Status(ctx context.Context, run *backendRun) (_ *runStatus, err error) {
+	defer func() { recordBackendRequest(BackendCodefresh, "status", err) }()
 
-	stdout, err := cmd.StdoutPipe()
+	build, err := b.client.GetBuild(ctx, run.ID)
 	if err != nil {
-		return errors.Wrap(err, "unable to create StdoutPipe")
+		return nil, err
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return errors.Wrap(err, "unable to create StderrPipe")
+
+	status := &runStatus{State: codefreshRunState(build.Status), URL: run.URL}
+	if build.Started != nil {
+		status.Started = *build.Started
+	}
+	if build.Finished != nil {
+		status.Finished = *build.Finished
 	}
 
-	merged := io.MultiReader(stderr, stdout)
-	go readCommandBuffer(bufio.NewScanner(merged))
+	if build.Progress == "" {
+		return status, nil
+	}
 
-	if err := cmd.Start(); err != nil {
-		return errors.Wrap(err, "unable to start command, buffer error")
+	// the steps are not critical, if we can't get them we still
+	// know the overall status of the build
+	steps, err := b.client.GetBuildProgress(ctx, build.Progress)
+	if err != nil {
+		logger.Warnw("unable to get codefresh build steps", "build", run.ID, "error", err)
+		return status, nil
 	}
 
-	err = cmd.Wait()
-	if err == nil {
-		success = true
+	for _, step := range steps {
+		switch step.Status {
+		case "running":
+			status.Step = step.displayName()
+		case "error", "failure":
+			if status.FailedStep == "" {
+				status.FailedStep = step.displayName()
+			}
+		}
 	}
-	return err
+	return status, nil
 }
 
-func readCommandBuffer(scanner *bufio.Scanner) {
-	for scanner.Scan() {
-		logger.Info(scanner.Text())
-	}
+func (b *codefreshBackend) Cancel(ctx context.Context, run *backendRun) (err error) {
+	defer func() { recordBackendRequest(BackendCodefresh, "cancel", err) }()
+
+	return b.client.TerminateBuild(ctx, run.ID)
 }
 
-func (config *c) GenerateCodefreshCommandFor(repo string) *exec.Cmd {
-	for _, p := range config.Projects {
-		if repo == p.Repository {
-			args := []string{"run", p.Pipeline, "--cfconfig", config.CodefreshCfg}
+func (s codefreshStep) displayName() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	return s.Name
+}
 
-			for _, v := range p.Variables {
-				args = append(args, "-v", v)
-			}
+// BuildURL returns the link to the build in the Codefresh UI, which is
+// served by the same host as the API
+func (cf *codefreshClient) BuildURL(id string) string {
+	return cf.baseURL + "/build/" + url.PathEscape(id)
+}
 
-			return exec.Command("codefresh", args...)
-		}
+// codefreshRunState translates the status of a Codefresh build into a run state
+func codefreshRunState(status string) string {
+	switch status {
+	case "success":
+		return RunStateSuccess
+	case "error":
+		return RunStateFailed
+	case "terminated":
+		return RunStateCancelled
+	case "running", "terminating":
+		return RunStateRunning
+	default:
+		return RunStatePending
 	}
-	return exec.Command("")
 }
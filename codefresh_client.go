@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultCodefreshURL = "https://g.codefresh.io"
+
+// codefreshClient is a minimal client of the Codefresh API
+//
+// https://g.codefresh.io/api/
+type codefreshClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// codefreshAPIError is returned when the Codefresh API responds with an error
+type codefreshAPIError struct {
+	StatusCode int    `json:"-"`
+	Status     int    `json:"status"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Message    string `json:"message"`
+}
+
+func (e *codefreshAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("codefresh api error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("codefresh api error: %d %s", e.StatusCode, e.Message)
+}
+
+// isCodefreshNotFound returns true if the error is a Codefresh API error
+// telling us that the requested resource doesn't exist
+func isCodefreshNotFound(err error) bool {
+	var apiErr *codefreshAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// codefreshBuild is a single run of a Codefresh pipeline (also known as workflow)
+type codefreshBuild struct {
+	ID           string     `json:"id"`
+	Status       string     `json:"status"`
+	PipelineName string     `json:"pipelineName"`
+	Branch       string     `json:"branchName"`
+	Revision     string     `json:"revision"`
+	UserName     string     `json:"userName"`
+	Progress     string     `json:"progress"`
+	Created      *time.Time `json:"created"`
+	Started      *time.Time `json:"started"`
+	Finished     *time.Time `json:"finished"`
+}
+
+// codefreshStep is a step of a build, as reported by the build progress
+type codefreshStep struct {
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+}
+
+// codefreshRunOptions are the options to run a pipeline
+type codefreshRunOptions struct {
+	Branch    string            `json:"branch,omitempty"`
+	Sha       string            `json:"sha,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// codefreshBuildsFilter filters the list of builds
+type codefreshBuildsFilter struct {
+	Pipeline string
+	Status   string
+	Limit    int
+}
+
+func newCodefreshClient(baseURL, apiKey string, httpClient *http.Client) *codefreshClient {
+	if baseURL == "" {
+		baseURL = defaultCodefreshURL
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &codefreshClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		http:    httpClient,
+	}
+}
+
+// newCodefreshClientFromEnv returns a client authenticated with the
+// CODEFRESH_API_KEY environment variable, CODEFRESH_URL can be used
+// to point to a different Codefresh installation
+func newCodefreshClientFromEnv() *codefreshClient {
+	return newCodefreshClient(os.Getenv("CODEFRESH_URL"), os.Getenv("CODEFRESH_API_KEY"), nil)
+}
+
+// RunPipeline runs the provided pipeline and returns the ID of the new build
+func (cf *codefreshClient) RunPipeline(ctx context.Context, pipeline string, opts codefreshRunOptions) (string, error) {
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return "", err
+	}
+
+	var out json.RawMessage
+	err = cf.do(ctx, http.MethodPost, "/api/pipelines/run/"+url.PathEscape(pipeline), bytes.NewReader(body), &out)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to run pipeline %s", pipeline)
+	}
+
+	// the API responds with the build ID as a JSON string
+	var id string
+	if err := json.Unmarshal(out, &id); err != nil {
+		id = string(out)
+	}
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return "", errors.Errorf("unable to run pipeline %s: no build ID returned", pipeline)
+	}
+	return id, nil
+}
+
+// GetBuild returns the build with the provided ID
+func (cf *codefreshClient) GetBuild(ctx context.Context, id string) (*codefreshBuild, error) {
+	var build codefreshBuild
+	if err := cf.do(ctx, http.MethodGet, "/api/builds/"+url.PathEscape(id), nil, &build); err != nil {
+		return nil, errors.Wrapf(err, "unable to get build %s", id)
+	}
+	return &build, nil
+}
+
+// GetBuildProgress returns the steps of a build, the progress ID
+// is found in the 'progress' field of the build
+func (cf *codefreshClient) GetBuildProgress(ctx context.Context, progressID string) ([]codefreshStep, error) {
+	var out struct {
+		Steps []codefreshStep `json:"steps"`
+	}
+	if err := cf.do(ctx, http.MethodGet, "/api/progress/"+url.PathEscape(progressID), nil, &out); err != nil {
+		return nil, errors.Wrapf(err, "unable to get build progress %s", progressID)
+	}
+	return out.Steps, nil
+}
+
+// ListBuilds returns the most recent builds that match the provided filter
+func (cf *codefreshClient) ListBuilds(ctx context.Context, filter codefreshBuildsFilter) ([]codefreshBuild, error) {
+	query := url.Values{}
+	if filter.Pipeline != "" {
+		query.Set("pipeline", filter.Pipeline)
+	}
+	if filter.Status != "" {
+		query.Set("status", filter.Status)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	var out struct {
+		Workflows struct {
+			Docs []codefreshBuild `json:"docs"`
+		} `json:"workflows"`
+	}
+	if err := cf.do(ctx, http.MethodGet, "/api/workflow?"+query.Encode(), nil, &out); err != nil {
+		return nil, errors.Wrap(err, "unable to list builds")
+	}
+	return out.Workflows.Docs, nil
+}
+
+// GetPipeline returns an error if the pipeline doesn't exist, the name
+// of the pipeline is in the format PROJECT/PIPELINE
+func (cf *codefreshClient) GetPipeline(ctx context.Context, name string) error {
+	err := cf.do(ctx, http.MethodGet, "/api/pipelines/"+url.PathEscape(name), nil, nil)
+	return errors.Wrapf(err, "unable to get pipeline %s", name)
+}
+
+// CurrentUser returns the name of the user that owns the API key
+func (cf *codefreshClient) CurrentUser(ctx context.Context) (string, error) {
+	var out struct {
+		UserName string `json:"userName"`
+	}
+	if err := cf.do(ctx, http.MethodGet, "/api/user", nil, &out); err != nil {
+		return "", errors.Wrap(err, "unable to get current user")
+	}
+	return out.UserName, nil
+}
+
+// TerminateBuild stops a build that is in progress
+func (cf *codefreshClient) TerminateBuild(ctx context.Context, id string) error {
+	err := cf.do(ctx, http.MethodPost, "/api/builds/"+url.PathEscape(id)+"/terminate", nil, nil)
+	return errors.Wrapf(err, "unable to terminate build %s", id)
+}
+
+func (cf *codefreshClient) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	if cf.apiKey == "" {
+		return errors.New("CODEFRESH_API_KEY must be set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cf.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", cf.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	logger.Debugw("codefresh api request", "method", method, "path", path)
+	res, err := cf.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to read response body")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := &codefreshAPIError{}
+		if err := json.Unmarshal(data, apiErr); err != nil {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		apiErr.StatusCode = res.StatusCode
+		return apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCodefresh serves the Codefresh API endpoints used by ally
+func fakeCodefresh(t *testing.T, handler http.HandlerFunc) *codefreshClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "secret-key" {
+			t.Errorf("expected the API key in the Authorization header, got '%s'", got)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return newCodefreshClient(server.URL+"/", "secret-key", server.Client())
+}
+
+func TestCodefreshTrigger(t *testing.T) {
+	client := fakeCodefresh(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.EscapedPath() != "/api/pipelines/run/go-sdk%2Fprepare-release" {
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+		}
+
+		var opts codefreshRunOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			t.Fatal(err)
+		}
+		if opts.Branch != "main" || opts.Sha != "abc1234" || opts.Variables["BUMP"] != "minor" {
+			t.Errorf("unexpected run options %+v", opts)
+		}
+		io.WriteString(w, `"5f0c1a2b3c"`)
+	})
+
+	run, err := newCodefreshBackend(client).Trigger(context.Background(), &triggerRequest{
+		Pipeline:  "go-sdk/prepare-release",
+		Ref:       "main",
+		Sha:       "abc1234",
+		Variables: []string{"BUMP=minor"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != "5f0c1a2b3c" {
+		t.Errorf("expected build ID 5f0c1a2b3c, got '%s'", run.ID)
+	}
+	if want := client.baseURL + "/build/5f0c1a2b3c"; run.URL != want {
+		t.Errorf("expected build URL '%s', got '%s'", want, run.URL)
+	}
+}
+
+func TestCodefreshTriggerErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		body    string
+		request *triggerRequest
+		want    string
+	}{
+		{"api error", http.StatusBadRequest, `{"status":400,"message":"pipeline is disabled"}`,
+			&triggerRequest{Pipeline: "p"}, "pipeline is disabled"},
+		{"plain text error", http.StatusBadGateway, "upstream down",
+			&triggerRequest{Pipeline: "p"}, "upstream down"},
+		{"no build ID", http.StatusOK, `""`,
+			&triggerRequest{Pipeline: "p"}, "no build ID returned"},
+		{"malformed variable", http.StatusOK, `"id"`,
+			&triggerRequest{Pipeline: "p", Variables: []string{"NOPE"}}, "malformed variable"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fakeCodefresh(t, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+			_, err := newCodefreshBackend(client).Trigger(context.Background(), tc.request)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected an error containing '%s', got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestCodefreshMissingAPIKey(t *testing.T) {
+	client := newCodefreshClient("http://127.0.0.1:0", "", nil)
+	if _, err := client.GetBuild(context.Background(), "id"); err == nil ||
+		!strings.Contains(err.Error(), "CODEFRESH_API_KEY") {
+		t.Errorf("expected an error about CODEFRESH_API_KEY, got %v", err)
+	}
+}
+
+func TestCodefreshNotFound(t *testing.T) {
+	client := fakeCodefresh(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"status":404,"message":"Pipeline not found"}`)
+	})
+	err := client.GetPipeline(context.Background(), "nope/nope")
+	if !isCodefreshNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestCodefreshStatus(t *testing.T) {
+	started := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	client := fakeCodefresh(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/builds/b1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "b1", "status": "running", "progress": "p1", "started": started,
+			})
+		case "/api/progress/p1":
+			io.WriteString(w, `{"steps":[
+				{"name":"clone","status":"success"},
+				{"name":"build","title":"Build the CLI","status":"running"}
+			]}`)
+		default:
+			t.Fatalf("unexpected request %s", r.URL.Path)
+		}
+	})
+
+	status, err := newCodefreshBackend(client).Status(context.Background(), &backendRun{ID: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != RunStateRunning || status.Step != "Build the CLI" || !status.Started.Equal(started) {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestCodefreshStatusWithoutSteps(t *testing.T) {
+	client := fakeCodefresh(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/builds/b1":
+			io.WriteString(w, `{"id":"b1","status":"error","progress":"p1"}`)
+		default:
+			// the steps are optional, the status comes from the build
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	status, err := newCodefreshBackend(client).Status(context.Background(), &backendRun{ID: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != RunStateFailed || !status.Done() {
+		t.Errorf("expected a failed run, got %+v", status)
+	}
+}
+
+func TestCodefreshRunState(t *testing.T) {
+	cases := map[string]string{
+		"success":     RunStateSuccess,
+		"error":       RunStateFailed,
+		"terminated":  RunStateCancelled,
+		"running":     RunStateRunning,
+		"terminating": RunStateRunning,
+		"pending":     RunStatePending,
+		"elected":     RunStatePending,
+		"":            RunStatePending,
+	}
+	for status, want := range cases {
+		if got := codefreshRunState(status); got != want {
+			t.Errorf("codefreshRunState(%q) = %s, expected %s", status, got, want)
+		}
+	}
+}
+
+func TestCodefreshCancel(t *testing.T) {
+	terminated := false
+	client := fakeCodefresh(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/builds/b1/terminate" {
+			terminated = true
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	backend := newCodefreshBackend(client)
+	if err := backend.Cancel(context.Background(), &backendRun{ID: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !terminated {
+		t.Error("expected the build to be terminated")
+	}
+	if err := backend.Cancel(context.Background(), &backendRun{ID: "b2"}); !isCodefreshNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestCodefreshDescribeRedactsSecrets(t *testing.T) {
+	redactor.RegisterVariableNames("API_TOKEN")
+	client := newCodefreshClient("https://codefresh.example.com", "secret-key", nil)
+
+	call, err := newCodefreshBackend(client).Describe(&triggerRequest{
+		Pipeline:  "p/release",
+		Variables: []string{"API_TOKEN=hunter22", "BUMP=patch"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(call, "hunter22") || !strings.Contains(call, "BUMP") {
+		t.Errorf("unexpected description '%s'", call)
+	}
+	if !strings.HasPrefix(call, "POST https://codefresh.example.com/api/pipelines/run/p%2Frelease ") {
+		t.Errorf("unexpected call '%s'", call)
+	}
+}
+
+func TestNewBackendUsesFactories(t *testing.T) {
+	client := fakeCodefresh(t, func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, `"b1"`)
+	})
+
+	original := backends[BackendCodefresh]
+	backends[BackendCodefresh] = func() releaseBackend { return newCodefreshBackend(client) }
+	defer func() { backends[BackendCodefresh] = original }()
+
+	config := &c{Projects: []project{{Repository: "go-sdk", Pipeline: "go-sdk/prepare-release"}}}
+	backend, err := config.backendFor(&config.Projects[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := backend.Trigger(context.Background(), config.Projects[0].TriggerRequest())
+	if err != nil || run.ID != "b1" {
+		t.Errorf("expected the injected backend to trigger build b1, got %+v, %v", run, err)
+	}
+
+	if _, err := newBackend("jenkins"); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
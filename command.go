@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+// how many projects are suggested for an unknown input
+const maxProjectSuggestions = 3
+
+const releaseCommandUsage = `*Usage:*
+• ` + "`/release`" + ` pick the project to release from a menu
+• ` + "`/release <project>`" + ` release a project
+• ` + "`/release list`" + ` list the projects you can release from this channel
+• ` + "`/release status [project]`" + ` show the releases in progress and in the queue
+• ` + "`/release cancel <job>`" + ` cancel a release in progress
+• ` + "`/release history [project]`" + ` show the recent releases, ` + "`/release history export [json|csv]`" + ` exports them
+• ` + "`/release reload`" + ` reload the config (admins only)
+• ` + "`/release help`" + ` show this message`
+
+// releaseSubcommands are the words that '/release' takes as subcommands,
+// a project named like one of them could never be released by name
+var releaseSubcommands = []string{"help", "list", "status", "cancel", "history", "reload"}
+
+// isReleaseSubcommand returns true if '/release <name>' runs a subcommand
+func isReleaseSubcommand(name string) bool {
+	return contains(releaseSubcommands, strings.ToLower(strings.TrimSpace(name)))
+}
+
+// handleReleaseCommand handles the '/release' slash command and its
+// subcommands, it returns the response to the command
+func handleReleaseCommand(ctx context.Context, api *slack.Client, config *c, cmd slack.SlashCommand) map[string]interface{} {
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 {
+		notifySlackChannel(ctx, api,
+			config.NotifySlackChannel,
+			fmt.Sprintf("User %s is preparing a release via `/release`", cmd.UserName),
+		)
+		return renderSlackCommandPayload(ctx, api, config, cmd.UserID, cmd.ChannelID)
+	}
+
+	subcommand, args := strings.ToLower(args[0]), args[1:]
+	switch subcommand {
+	case "help":
+		return ephemeralResponse(releaseCommandUsage)
+	case "list":
+		if len(args) != 0 {
+			return usageError("`/release list` takes no arguments.")
+		}
+		return handleListCommand(ctx, api, config, cmd.UserID, cmd.ChannelID)
+	case "status":
+		if len(args) > 1 {
+			return usageError("`/release status` takes at most one project.")
+		}
+		return handleStatusCommand(ctx, api, config, cmd.UserID, cmd.ChannelID, args)
+	case "cancel":
+		if len(args) != 1 {
+			return usageError("`/release cancel` needs the ID of the job, `/release status` shows it.")
+		}
+		return handleCancelCommand(ctx, api, config, cmd.UserID, cmd.ChannelID, args[0])
+	case "history":
+		return handleHistoryCommand(ctx, api, config, cmd, args)
+	case "reload":
+		return handleReloadCommand(ctx, api, config, cmd.UserID, cmd.ChannelID)
+	}
+
+	if len(args) != 0 {
+		return usageError("`/release <project>` takes no arguments.")
+	}
+	return handleReleaseProjectCommand(ctx, api, config, cmd, cmd.Text)
+}
+
+// respondToCommand sends the response of a slash command to its response
+// URL, the command itself is acknowledged as soon as it arrives
+func respondToCommand(ctx context.Context, api *slack.Client, cmd slack.SlashCommand, res map[string]interface{}) {
+	if res == nil {
+		return
+	}
+
+	responseType := slack.ResponseTypeEphemeral
+	if t, ok := res["response_type"].(string); ok && t != "" {
+		responseType = t
+	}
+	opts := []slack.MsgOption{slack.MsgOptionResponseURL(cmd.ResponseURL, responseType)}
+	if text, ok := res["text"].(string); ok {
+		opts = append(opts, slack.MsgOptionText(text, false))
+	}
+	if blocks, ok := res["blocks"].([]slack.Block); ok {
+		opts = append(opts, slack.MsgOptionBlocks(blocks...))
+	}
+	postSlackMessage(ctx, api, cmd.ChannelID, opts...)
+}
+
+// usageError is the response to a slash command that was used wrong
+func usageError(msg string) map[string]interface{} {
+	return ephemeralResponse(":warning: " + msg + "\n\n" + releaseCommandUsage)
+}
+
+// handleReleaseProjectCommand handles '/release <project>', it skips the menu
+// and opens the release form right away
+func handleReleaseProjectCommand(ctx context.Context, api *slack.Client, config *c, cmd slack.SlashCommand, name string) map[string]interface{} {
+	name = strings.TrimSpace(name)
+	p, ok := config.FindProject(name)
+	if !ok {
+		p, ok = findProjectFold(config, name)
+	}
+	if !ok {
+		return unknownProject(config.AllowedProjects(ctx, api, cmd.UserID, cmd.ChannelID), name)
+	}
+
+	what := fmt.Sprintf("release the *%s* project", p.Repository)
+	if !p.Access.Allows(ctx, api, cmd.UserID, cmd.ChannelID) {
+		recordDeniedAccess(ctx, api, config, cmd.UserID, cmd.ChannelID, what)
+		return ephemeralResponse(fmt.Sprintf(":no_entry: Sorry, you are not allowed to %s from this channel.", what))
+	}
+
+	notifySlackChannel(ctx, api,
+		config.NotifySlackChannel,
+		fmt.Sprintf("User %s is preparing a release of *%s* via `/release`", cmd.UserName, p.Repository),
+	)
+
+	if holders, busy := releaseHolders(config.ConcurrencyFor(p)); busy {
+		return map[string]interface{}{
+			"response_type": "ephemeral",
+			"blocks":        renderBusyProject(p, holders),
+		}
+	}
+
+	// the trigger ID of the command expires in a few seconds, the form
+	// is opened before anything else
+	err := openReleaseForm(ctx, api, cmd.TriggerID, p, releaseFormMetadata{
+		Project:     p.Repository,
+		Channel:     cmd.ChannelID,
+		ResponseURL: cmd.ResponseURL,
+	})
+	if err != nil {
+		logger.Errorw("unable to open release form", "project", p.Repository, "error", err)
+		return ephemeralResponse(":x: Sorry, I couldn't open the release form, try again in a moment.")
+	}
+	return ephemeralResponse(fmt.Sprintf(":memo: Fill in the form to release *%s*.", p.Repository))
+}
+
+// handleListCommand lists the projects the user can release from the channel
+func handleListCommand(ctx context.Context, api *slack.Client, config *c, user, channel string) map[string]interface{} {
+	allowed := config.AllowedProjects(ctx, api, user, channel)
+	if len(allowed) == 0 {
+		return ephemeralResponse(":no_entry: Sorry, you are not allowed to release any project from this channel.")
+	}
+
+	releasing := map[string]int{}
+	for _, j := range jobs.Active() {
+		releasing[j.Snapshot().Target]++
+	}
+
+	lines := []string{"*Projects you can release from this channel:*"}
+	for _, name := range allowed {
+		p, _ := config.FindProject(name)
+		line := fmt.Sprintf("• *%s* — %s `%s`", p.Repository, p.BackendName(), p.Pipeline)
+		if p.Approval != nil {
+			line += " :lock:"
+		}
+		if n := releasing[p.Repository]; n != 0 {
+			line += fmt.Sprintf(" :construction: %d in progress", n)
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "", "_:lock: needs an approval, :construction: is being released_")
+	return ephemeralResponse(strings.Join(lines, "\n"))
+}
+
+// handleStatusCommand shows the releases in progress and the queued ones
+// that the user has access to, optionally only the ones of a project
+func handleStatusCommand(ctx context.Context, api *slack.Client, config *c, user, channel string, args []string) map[string]interface{} {
+	allowed := config.AllowedProjects(ctx, api, user, channel)
+
+	var target string
+	if len(args) != 0 {
+		p, ok := config.FindProject(args[0])
+		if !ok {
+			p, ok = findProjectFold(config, args[0])
+		}
+		if !ok || !p.Access.Allows(ctx, api, user, channel) {
+			return unknownProject(allowed, args[0])
+		}
+		target = p.Repository
+	}
+
+	// users only see the releases of the projects and the runs of the
+	// workflows they have access to
+	projects := map[string]bool{}
+	for _, name := range allowed {
+		projects[name] = true
+	}
+	workflows := map[string]bool{}
+	for _, wf := range config.Workflows {
+		workflows[wf.Name] = wf.Access.Allows(ctx, api, user, channel)
+	}
+
+	lines := []string{}
+	for _, j := range jobs.Active() {
+		s := j.Snapshot()
+		if target != "" && s.Target != target {
+			continue
+		}
+		if (s.Kind == ApprovalTargetWorkflow && !workflows[s.Target]) ||
+			(s.Kind != ApprovalTargetWorkflow && !projects[s.Target]) {
+			continue
+		}
+
+		line := fmt.Sprintf("• `%s` *%s* — %s", s.ID, s.Target, s.State)
+		if s.Step != "" {
+			line += " (" + s.Step + ")"
+		}
+		if s.Requester != "" {
+			line += " by " + mentionUser(s.Requester)
+		}
+		if !s.StartedAt.IsZero() {
+			line += fmt.Sprintf(", started %s ago", time.Since(s.StartedAt).Round(time.Second))
+		}
+		if s.Run != nil && s.Run.URL != "" {
+			line += fmt.Sprintf(" <%s|build>", s.Run.URL)
+		}
+		lines = append(lines, line)
+	}
+
+	for _, slot := range queuedReleases() {
+		if (target != "" && slot.Target != target) || !projects[slot.Target] {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("• *%s* — queued by %s %s ago",
+			slot.Target, mentionUser(slot.User), time.Since(slot.Since).Round(time.Second)))
+	}
+
+	if len(lines) == 0 {
+		if target != "" {
+			return ephemeralResponse(fmt.Sprintf("*%s* is not being released right now.", target))
+		}
+		return ephemeralResponse("Nothing is being released right now. :sunny:")
+	}
+
+	title := "*Releases in progress:*"
+	if target != "" {
+		title = fmt.Sprintf("*Releases of %s in progress:*", target)
+	}
+	lines = append([]string{title}, lines...)
+	lines = append(lines, "", "_Cancel one with `/release cancel <job>`_")
+	return ephemeralResponse(strings.Join(lines, "\n"))
+}
+
+// handleCancelCommand cancels a job in progress, the job can be referred to
+// by the beginning of its ID as long as it is not ambiguous
+func handleCancelCommand(ctx context.Context, api *slack.Client, config *c, user, channel, id string) map[string]interface{} {
+	matches := []*job{}
+	for _, j := range jobs.Active() {
+		if j.ID == id {
+			matches = []*job{j}
+			break
+		}
+		if strings.HasPrefix(j.ID, id) {
+			matches = append(matches, j)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		return ephemeralResponse(fmt.Sprintf(":warning: There is no release in progress with the ID `%s`, "+
+			"`/release status` shows the ones in progress.", id))
+	case len(matches) > 1:
+		return ephemeralResponse(fmt.Sprintf(":warning: `%s` matches %d releases, use more of the ID.", id, len(matches)))
+	}
+
+	j := matches[0]
+	s := j.Snapshot()
+	if !config.canCancelJob(ctx, api, j, user, channel) {
+		logger.Warnw("unauthorized cancel attempt", "job", s.ID, "target", s.Target, "user", user)
+		return ephemeralResponse(fmt.Sprintf(":no_entry: You are not allowed to cancel *%s*.", s.Target))
+	}
+
+	err := eventExecutor.Submit(&task{
+		Name:    "cancel of " + s.Target,
+		Channel: channel,
+		Run: func(ctx context.Context) error {
+			cancelJob(ctx, api, config, s.ID, user, channel)
+			return nil
+		},
+	})
+	if err != nil {
+		return ephemeralResponse(rejectedMessage(err, "cancel *"+s.Target+"*"))
+	}
+	return ephemeralResponse(fmt.Sprintf(":no_entry_sign: Cancelling *%s* (`%s`)...", s.Target, s.ID))
+}
+
+// unknownProject tells the user that the project doesn't exist and suggests
+// the projects with the closest names
+func unknownProject(projects []string, name string) map[string]interface{} {
+	msg := fmt.Sprintf("I don't know the project or command `%s`.", name)
+	if suggestions := suggestProjects(projects, name); len(suggestions) != 0 {
+		msg += " Did you mean *" + strings.Join(suggestions, "*, *") + "*?"
+	}
+	return ephemeralResponse(":warning: " + msg + "\n`/release list` shows the projects you can release " +
+		"and `/release help` the commands.")
+}
+
+// findProjectFold finds a project ignoring the case of its name
+func findProjectFold(config *c, name string) (*project, bool) {
+	for i := range config.Projects {
+		if strings.EqualFold(config.Projects[i].Repository, name) {
+			return &config.Projects[i], true
+		}
+	}
+	return nil, false
+}
+
+// suggestProjects returns the projects whose names are close to the provided
+// one, the ones that contain it first and then by edit distance
+func suggestProjects(projects []string, name string) []string {
+	name = strings.ToLower(name)
+	maxDistance := utf8.RuneCountInString(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	type suggestion struct {
+		project  string
+		distance int
+	}
+	suggestions := []suggestion{}
+	for _, p := range projects {
+		lower := strings.ToLower(p)
+		switch d := levenshtein(lower, name); {
+		case strings.Contains(lower, name):
+			suggestions = append(suggestions, suggestion{p, 0})
+		case d <= maxDistance:
+			suggestions = append(suggestions, suggestion{p, d})
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+
+	out := []string{}
+	for i := 0; i < len(suggestions) && i < maxProjectSuggestions; i++ {
+		out = append(out, suggestions[i].project)
+	}
+	return out
+}
+
+// levenshtein returns the number of edits needed to turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// mentionUser mentions a Slack user, requesters that are not Slack users,
+// like releases started from the terminal, are shown as they are
+func mentionUser(id string) string {
+	if strings.HasPrefix(id, "U") || strings.HasPrefix(id, "W") {
+		return "<@" + id + ">"
+	}
+	return id
+}
@@ -1,27 +1,131 @@
 package main
 
 import (
-	"flag"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
 )
 
-var cFlag *string
+const defaultDataDir = "data"
 
-func init() {
-	cFlag = flag.String("c", "ally.toml", "path to TOML config file")
-	flag.Parse()
+type c struct {
+	NotifySlackChannel string     `toml:"notify_slack_channel"`
+	SecretVariables    []string   `toml:"secret_variables,omitempty"`
+	DataDir            string     `toml:"data_dir,omitempty"`
+	Projects           []project  `toml:"project"`
+	Workflows          []workflow `toml:"workflow"`
+
+	// How long a release can be undone after selecting a project,
+	// defaults to 10s, set it to "0s" to release right away
+	GracePeriod *duration `toml:"grace_period,omitempty"`
+
+	// How long ally waits for releases in progress when it is stopped,
+	// defaults to 25s, keep it below the stop timeout of the container
+	ShutdownTimeout duration `toml:"shutdown_timeout,omitempty"`
+
+	// Number of releases that can run at the same time for the projects
+	// that share a concurrency group
+	ConcurrencyGroups map[string]int `toml:"concurrency_groups,omitempty"`
+
+	// Limits of the executor that runs releases and workflows, optional
+	Executor executorConfig `toml:"executor,omitempty"`
+
+	// Address of the health and diagnostics server, defaults to ':8080'
+	HTTPAddr string `toml:"http_addr,omitempty"`
+
+	// Who can reload the config from Slack with '/release reload'
+	Admins *accessPolicy `toml:"admins,omitempty"`
+
+	// Simulate releases instead of triggering them, read when ally starts
+	DryRun bool `toml:"dry_run,omitempty"`
+
+	// where the config was loaded from and the SHA-256 of its content
+	path string
+	hash string
 }
 
-type c struct {
-	NotifySlackChannel string `toml:"notify_slack_channel"`
-	CodefreshCfg       string `toml:"codefresh_config,omitempty"`
-	Projects           []struct {
-		Repository string   `toml:"repository"`
-		Pipeline   string   `toml:"pipeline"`
-		Variables  []string `toml:"variables,omitempty"`
-	} `toml:"project"`
+type executorConfig struct {
+	// Releases and workflows that run at the same time, defaults to 8
+	Workers int `toml:"workers,omitempty"`
+
+	// Releases and workflows waiting for a worker before ally starts
+	// turning them down, defaults to 32
+	Queue int `toml:"queue,omitempty"`
+
+	// How long a release or workflow can run, defaults to 3h
+	JobTimeout duration `toml:"job_timeout,omitempty"`
+}
+
+type project struct {
+	Repository string `toml:"repository"`
+
+	// Backend used to release the project, either 'codefresh' (default)
+	// or 'github'
+	Backend string `toml:"backend,omitempty"`
+
+	// Codefresh pipeline or Github workflow (ID or file name)
+	Pipeline  string   `toml:"pipeline"`
+	Variables []string `toml:"variables,omitempty"`
+
+	// Branch or tag to release from, the default branch of the pipeline
+	// when empty, users can pick another one in the release form
+	Ref string `toml:"ref,omitempty"`
+
+	// Only used by the Github backend
+	GithubRepo       string `toml:"github_repo,omitempty"`
+	CorrelationInput string `toml:"correlation_input,omitempty"`
+
+	// Prompts shown in the release form, they work like the inputs of
+	// workflows and a prompt named like a variable overrides it
+	Prompts []workflowInput `toml:"prompt,omitempty"`
+
+	// Who can release the project and from where, optional
+	Access *accessPolicy `toml:"access,omitempty"`
+
+	// Approvals needed before releasing the project, optional
+	Approval *approvalPolicy `toml:"approval,omitempty"`
+
+	// Releases of the project that can run at the same time (default 1),
+	// ignored when the project is part of a concurrency group
+	Concurrency      int    `toml:"concurrency,omitempty"`
+	ConcurrencyGroup string `toml:"concurrency_group,omitempty"`
+}
+
+// workflow is a Github workflow that can be dispatched from Slack
+type workflow struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description,omitempty"`
+
+	// Repository in the format [HOST/]OWNER/REPO
+	Repo string `toml:"repo"`
+
+	// Workflow ID or file name
+	Workflow         string          `toml:"workflow"`
+	Ref              string          `toml:"ref,omitempty"`
+	CorrelationInput string          `toml:"correlation_input,omitempty"`
+	Inputs           []workflowInput `toml:"input,omitempty"`
+
+	// Who can run the workflow and from where, optional
+	Access *accessPolicy `toml:"access,omitempty"`
+
+	// Approvals needed before running the workflow, optional
+	Approval *approvalPolicy `toml:"approval,omitempty"`
+}
+
+type workflowInput struct {
+	Name        string `toml:"name"`
+	Label       string `toml:"label,omitempty"`
+	Description string `toml:"description,omitempty"`
+
+	// Type of the input, either 'string' (default), 'choice', 'boolean' or 'number'
+	Type     string   `toml:"type,omitempty"`
+	Choices  []string `toml:"choices,omitempty"`
+	Default  string   `toml:"default,omitempty"`
+	Required bool     `toml:"required,omitempty"`
 }
 
 //
@@ -29,7 +133,23 @@ type c struct {
 //
 // ```toml
 // notify_slack_channel = "C011B98EA5U"
-// codefresh_config = "/foo/bar/.cfconfig"
+// secret_variables = ["NPM_TOKEN"]
+// data_dir = "/var/lib/ally"
+// grace_period = "15s"
+// shutdown_timeout = "90s"
+// http_addr = ":8080"
+// dry_run = false
+//
+// [concurrency_groups]
+// terraform-modules = 2
+//
+// [admins]
+// users = ["U0279A42HV0"]
+//
+// [executor]
+// workers = 8
+// queue = 32
+// job_timeout = "3h"
 //
 // [[project]]
 // repository = "go-sdk"
@@ -43,29 +163,132 @@ type c struct {
 // repository = "terraform-gcp-config"
 // pipeline  = "terraform-modules/prepare-release-for"
 // variables = ["TF_MODULE=terraform-gcp-config"]
+// concurrency_group = "terraform-modules"
 //
 // [[project]]
 // repository = "terraform-aws-ecr"
 // pipeline  = "terraform-modules/prepare-release-for"
 // variables = ["TF_MODULE=terraform-aws-ecr"]
+// concurrency_group = "terraform-modules"
+//
+// [project.access]
+// users = ["U0279A42HV0"]
+// groups = ["S01JP5A3ACQ"]
+// channels = ["C011B98EA5U"]
+//
+// [[project]]
+// repository = "lacework-cli"
+// backend = "github"
+// github_repo = "lacework/go-sdk"
+// pipeline = "prepare-release.yml"
+// ref = "main"
+// variables = ["bump=minor"]
+// correlation_input = "ally_id"
+//
+// [[project.prompt]]
+// name = "bump"
+// type = "choice"
+// choices = ["patch", "minor", "major"]
+// required = true
+//
+// [[workflow]]
+// name = "deploy-docs"
+// description = "Publish the documentation site"
+// repo = "lacework/docs"
+// workflow = "deploy.yml"
+// ref = "main"
+//
+// [[workflow.input]]
+// name = "environment"
+// type = "choice"
+// choices = ["staging", "production"]
+// default = "staging"
+// required = true
+//
+// [[workflow.input]]
+// name = "purge_cache"
+// type = "boolean"
+//
+// [workflow.approval]
+// approver_group = "S01JP5A3ACQ"
+// approvals = 2
+// justification = true
+// expiry = "2h"
+//
+// [[workflow]]
+// name = "sign-cli"
+// repo = "lacework-dev/lacework-cli-signing"
+// workflow = "32728677"
+//
+// [[workflow.input]]
+// name = "branch_or_tag"
+// required = true
+//
+// [workflow.approval]
+// approver_group = "S01JP5A3ACQ"
+// mfa_input = "mfa_token"
 // ```
 
+// MFAInputs returns the names of the variables that receive MFA tokens
+func (config *c) MFAInputs() []string {
+	names := []string{}
+	for _, p := range config.Projects {
+		if p.Approval != nil && p.Approval.MFAInput != "" {
+			names = append(names, p.Approval.MFAInput)
+		}
+	}
+	for _, wf := range config.Workflows {
+		if wf.Approval != nil && wf.Approval.MFAInput != "" {
+			names = append(names, wf.Approval.MFAInput)
+		}
+	}
+	return names
+}
+
 func LoadConfig(f string) (*c, error) {
 	logger.Infow("loading config", "path", f)
 
-	var config c
-	if _, err := toml.DecodeFile(f, &config); err != nil {
-		return nil, errors.Wrapf(err, "unable to decode config %s", f)
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read config %s", f)
+	}
+
+	config, problems, err := decodeConfig(f, string(data))
+	if err != nil {
+		return nil, err
 	}
+	errs, warnings := splitWarnings(problems)
+	if len(errs) != 0 {
+		return nil, &configProblems{path: f, problems: errs}
+	}
+	for _, w := range warnings {
+		logger.Warnw("config warning", "problem", w.format(f))
+	}
+	config.path = f
+	config.hash = fmt.Sprintf("%x", sha256.Sum256(data))
+
+	// the values of these variables must never show up in logs or Slack,
+	// neither do the MFA tokens typed by approvers
+	names := append(append([]string{}, config.SecretVariables...), config.MFAInputs()...)
+	redactor.SetVariableNames(names...)
 
 	for _, p := range config.Projects {
 		logger.Debugw("project loaded",
 			"repository", p.Repository,
+			"backend", p.BackendName(),
 			"pipeline", p.Pipeline,
 			"variables", p.Variables,
 		)
 	}
-	return &config, nil
+
+	for _, wf := range config.Workflows {
+		logger.Debugw("workflow loaded",
+			"name", wf.Name,
+			"repo", wf.Repo,
+			"workflow", wf.Workflow,
+		)
+	}
+	return config, nil
 }
 
 func (config *c) ListProjects() []string {
@@ -75,3 +298,166 @@ func (config *c) ListProjects() []string {
 	}
 	return out
 }
+
+// AuditLogPath returns the path of the audit log inside the data directory
+func (config *c) AuditLogPath() string {
+	return filepath.Join(config.DataDirectory(), "audit.jsonl")
+}
+
+// AuditAnchorPath returns the path of the anchor of the audit log, it is
+// kept with the jobs rather than next to the log
+func (config *c) AuditAnchorPath() string {
+	return filepath.Join(config.JobsDir(), "audit.anchor")
+}
+
+// DataDirectory returns the directory where ally keeps its data, like the
+// audit log and the jobs, defaults to 'data' in the current directory
+func (config *c) DataDirectory() string {
+	if config.DataDir == "" {
+		return defaultDataDir
+	}
+	return config.DataDir
+}
+
+// UndoGracePeriod returns how long a release can be undone after selecting a project
+func (config *c) UndoGracePeriod() time.Duration {
+	if config.GracePeriod == nil {
+		return defaultUndoGracePeriod
+	}
+	return config.GracePeriod.Duration
+}
+
+// ListenAddr returns the address of the health and diagnostics server
+func (config *c) ListenAddr() string {
+	if config.HTTPAddr == "" {
+		return defaultHTTPAddr
+	}
+	return config.HTTPAddr
+}
+
+// DrainTimeout returns how long ally waits for releases in progress when it is stopped
+func (config *c) DrainTimeout() time.Duration {
+	if config.ShutdownTimeout.Duration <= 0 {
+		return defaultShutdownTimeout
+	}
+	return config.ShutdownTimeout.Duration
+}
+
+// WorkerCount returns how many releases and workflows can run at the same time
+func (e *executorConfig) WorkerCount() int {
+	if e.Workers < 1 {
+		return defaultExecutorWorkers
+	}
+	return e.Workers
+}
+
+// QueueSize returns how many releases and workflows can wait for a worker
+func (e *executorConfig) QueueSize() int {
+	if e.Queue < 1 {
+		return defaultExecutorQueue
+	}
+	return e.Queue
+}
+
+// Timeout returns how long a release or workflow can run
+func (e *executorConfig) Timeout() time.Duration {
+	if e.JobTimeout.Duration <= 0 {
+		return defaultJobTimeout
+	}
+	return e.JobTimeout.Duration
+}
+
+// JobsDir returns the directory inside the data directory where jobs are persisted
+func (config *c) JobsDir() string {
+	return filepath.Join(config.DataDirectory(), "jobs")
+}
+
+// FindProject returns the project with the provided repository name
+func (config *c) FindProject(repo string) (*project, bool) {
+	for i := range config.Projects {
+		if config.Projects[i].Repository == repo {
+			return &config.Projects[i], true
+		}
+	}
+	return nil, false
+}
+
+// UsesBackend returns true if at least one project is released with the provided backend
+func (config *c) UsesBackend(backend string) bool {
+	for _, p := range config.Projects {
+		if p.BackendName() == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendName returns the backend of the project, Codefresh is the default
+func (p *project) BackendName() string {
+	if p.Backend == "" {
+		return BackendCodefresh
+	}
+	return p.Backend
+}
+
+// ConcurrencyFor returns the lock shared by the releases of the project
+// and how many of them can run at the same time
+func (config *c) ConcurrencyFor(p *project) (string, int) {
+	if p.ConcurrencyGroup != "" {
+		return "group:" + p.ConcurrencyGroup, config.ConcurrencyGroups[p.ConcurrencyGroup]
+	}
+	if p.Concurrency > 0 {
+		return "project:" + p.Repository, p.Concurrency
+	}
+	return "project:" + p.Repository, 1
+}
+
+// TriggerRequest returns the request to trigger a release of the project
+func (p *project) TriggerRequest() *triggerRequest {
+	return &triggerRequest{
+		Pipeline:  p.Pipeline,
+		Repo:      p.GithubRepo,
+		Ref:       p.Ref,
+		Variables: p.Variables,
+
+		CorrelationInput: p.CorrelationInput,
+	}
+}
+
+// FindWorkflow returns the workflow with the provided name
+func (config *c) FindWorkflow(name string) (*workflow, bool) {
+	for i := range config.Workflows {
+		if config.Workflows[i].Name == name {
+			return &config.Workflows[i], true
+		}
+	}
+	return nil, false
+}
+
+func (config *c) ListWorkflows() []string {
+	out := []string{}
+	for _, wf := range config.Workflows {
+		out = append(out, wf.Name)
+	}
+	return out
+}
+
+// TriggerRequest returns the request to dispatch the workflow with the provided inputs
+func (wf *workflow) TriggerRequest(variables []string) *triggerRequest {
+	return &triggerRequest{
+		Pipeline:  wf.Workflow,
+		Repo:      wf.Repo,
+		Ref:       wf.Ref,
+		Variables: variables,
+
+		CorrelationInput: wf.CorrelationInput,
+	}
+}
+
+// DisplayName returns the label of the input, or its name if not set
+func (input *workflowInput) DisplayName() string {
+	if input.Label != "" {
+		return input.Label
+	}
+	return input.Name
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// dryRunTag marks every Slack message sent in dry-run mode
+	dryRunTag = "[DRY RUN]"
+
+	// IDs of the simulated runs, they carry the time the run was triggered
+	dryRunIDPrefix = "dry-run-"
+
+	// host of the response URLs of interactions and slash commands
+	slackResponseURLHost = "hooks.slack.com"
+
+	// how long a simulated run waits to start and how long each step takes
+	dryRunPendingTime = 5 * time.Second
+	dryRunStepTime    = 15 * time.Second
+)
+
+// the steps of a simulated run
+var dryRunSteps = []string{"Prepare", "Build", "Release"}
+
+// dryRun is set when ally runs in dry-run mode, releases only log the call
+// they would make and Slack messages are tagged, it is read when ally starts
+var dryRun bool
+
+// dryRunBackend wraps a backend to simulate its runs, nothing is triggered
+// but the call that the backend would make is logged
+type dryRunBackend struct {
+	backend releaseBackend
+}
+
+// withDryRun wraps the backend with a dryRunBackend when dry is true
+func withDryRun(backend releaseBackend, dry bool) releaseBackend {
+	if !dry {
+		return backend
+	}
+	return &dryRunBackend{backend: backend}
+}
+
+func (b *dryRunBackend) Name() string {
+	return b.backend.Name()
+}
+
+func (b *dryRunBackend) Describe(req *triggerRequest) (string, error) {
+	return b.backend.Describe(req)
+}
+
+func (b *dryRunBackend) Trigger(_ context.Context, req *triggerRequest) (*backendRun, error) {
+	call, err := b.backend.Describe(req)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infow("dry run, not triggering", "backend", b.Name(), "call", call)
+	return &backendRun{
+		Backend: b.Name(),
+		ID:      dryRunIDPrefix + strconv.FormatInt(time.Now().UnixNano(), 10),
+		Repo:    req.Repo,
+		DryRun:  true,
+	}, nil
+}
+
+// Status simulates a run that goes through every step and succeeds unless
+// its job is cancelled, the progress comes from the time in the ID and the
+// cancellation from the saved job so they both survive restarts
+func (b *dryRunBackend) Status(_ context.Context, run *backendRun) (*runStatus, error) {
+	nanos, err := strconv.ParseInt(strings.TrimPrefix(run.ID, dryRunIDPrefix), 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid simulated run ID '%s'", run.ID)
+	}
+	triggered := time.Unix(0, nanos)
+	elapsed := time.Since(triggered)
+
+	// a run can be cancelled before it starts
+	if dryRunCancelled(run.ID) {
+		status := &runStatus{State: RunStateCancelled, Finished: time.Now()}
+		if elapsed >= dryRunPendingTime {
+			status.Started = triggered.Add(dryRunPendingTime)
+		}
+		return status, nil
+	}
+
+	status := &runStatus{State: RunStatePending}
+	if elapsed < dryRunPendingTime {
+		return status, nil
+	}
+	status.Started = triggered.Add(dryRunPendingTime)
+
+	step := int((elapsed - dryRunPendingTime) / dryRunStepTime)
+	if step >= len(dryRunSteps) {
+		status.State = RunStateSuccess
+		status.Finished = status.Started.Add(time.Duration(len(dryRunSteps)) * dryRunStepTime)
+		return status, nil
+	}
+
+	status.State = RunStateRunning
+	status.Step = dryRunSteps[step]
+	return status, nil
+}
+
+// Cancel has nothing to stop, the job of the run records who cancelled it
+// before the backend is called and Status reports the run as cancelled
+func (b *dryRunBackend) Cancel(_ context.Context, run *backendRun) error {
+	logger.Infow("dry run, not cancelling", "backend", b.Name(), "id", run.ID)
+	return nil
+}
+
+// dryRunCancelled returns true if the job following the simulated run was
+// cancelled
+func dryRunCancelled(id string) bool {
+	for _, j := range jobs.Active() {
+		s := j.Snapshot()
+		if s.Run != nil && s.Run.ID == id {
+			return s.CancelledBy != ""
+		}
+	}
+	return false
+}
+
+// dryRunHTTPClient tags the messages and the modals sent to Slack in dry-run
+// mode, it wraps the HTTP client of the Slack API so that no message is
+// missed, including the ones sent to response URLs
+type dryRunHTTPClient struct {
+	client interface {
+		Do(*http.Request) (*http.Response, error)
+	}
+}
+
+func (dc *dryRunHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	// messages sent to a response URL don't go through the Web API
+	isResponseURL := req.URL.Host == slackResponseURLHost
+	method := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	switch {
+	case isResponseURL:
+	case method == "chat.postMessage", method == "chat.postEphemeral", method == "chat.update":
+	case method == "views.open", method == "views.push", method == "views.update":
+	default:
+		return dc.client.Do(req)
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return dc.client.Do(req)
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	isForm := strings.HasPrefix(contentType, "application/x-www-form-urlencoded")
+	isJSON := strings.HasPrefix(contentType, "application/json")
+	if !isForm && !isJSON {
+		return dc.client.Do(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case isForm:
+		values, err := url.ParseQuery(string(body))
+		if err == nil {
+			if text := values.Get("text"); text != "" {
+				values.Set("text", tagDryRunText(text))
+			}
+			if blocks := values.Get("blocks"); blocks != "" {
+				values.Set("blocks", tagDryRunBlocks(blocks))
+			}
+			if view := values.Get("view"); view != "" {
+				values.Set("view", string(tagDryRunMessage([]byte(view))))
+			}
+			body = []byte(values.Encode())
+		}
+	case strings.HasPrefix(method, "views."):
+		body = tagDryRunViewRequest(body)
+	default:
+		body = tagDryRunMessage(body)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return dc.client.Do(req)
+}
+
+// tagDryRunMessage tags the text and the blocks of a JSON message, views
+// have blocks too
+func tagDryRunMessage(body []byte) []byte {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return body
+	}
+
+	var text string
+	if err := json.Unmarshal(msg["text"], &text); err == nil && text != "" {
+		msg["text"], _ = json.Marshal(tagDryRunText(text))
+	}
+	if blocks, ok := msg["blocks"]; ok {
+		msg["blocks"] = json.RawMessage(tagDryRunBlocks(string(blocks)))
+	}
+
+	tagged, err := json.Marshal(msg)
+	if err != nil {
+		return body
+	}
+	return tagged
+}
+
+// tagDryRunViewRequest tags the view of a views.* call
+func tagDryRunViewRequest(body []byte) []byte {
+	var call map[string]json.RawMessage
+	if err := json.Unmarshal(body, &call); err != nil {
+		return body
+	}
+	view, ok := call["view"]
+	if !ok {
+		return body
+	}
+	call["view"] = tagDryRunMessage(view)
+
+	tagged, err := json.Marshal(call)
+	if err != nil {
+		return body
+	}
+	return tagged
+}
+
+// tagDryRunViewResponse tags the view sent back when acknowledging the
+// submission of a modal, it never goes through the HTTP client
+func tagDryRunViewResponse(res *slack.ViewSubmissionResponse) {
+	if !dryRun || res == nil || res.View == nil {
+		return
+	}
+	res.View.Blocks.BlockSet = append([]slack.Block{dryRunContextBlock()}, res.View.Blocks.BlockSet...)
+}
+
+func tagDryRunText(text string) string {
+	if strings.HasPrefix(text, dryRunTag) {
+		return text
+	}
+	return dryRunTag + " " + text
+}
+
+// tagDryRunBlocks adds a context block on top of the blocks of a message
+func tagDryRunBlocks(blocks string) string {
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(blocks), &list); err != nil {
+		return blocks
+	}
+
+	tag, err := json.Marshal(dryRunContextBlock())
+	if err != nil {
+		return blocks
+	}
+	// the menu of '/release' comes with the tag already
+	if len(list) != 0 && bytes.Equal(list[0], tag) {
+		return blocks
+	}
+
+	tagged, err := json.Marshal(append([]json.RawMessage{tag}, list...))
+	if err != nil {
+		return blocks
+	}
+	return string(tagged)
+}
+
+func dryRunContextBlock() *slack.ContextBlock {
+	return slack.NewContextBlock("",
+		slack.NewTextBlockObject(slack.MarkdownType,
+			":test_tube: *"+dryRunTag+"* nothing is really triggered", false, false),
+	)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	defaultExecutorWorkers = 8
+	defaultExecutorQueue   = 32
+	defaultJobTimeout      = 3 * time.Hour
+
+	// Slack events are handled by their own executor so that long
+	// releases never delay them
+	eventExecutorWorkers = 4
+	eventExecutorQueue   = 64
+	eventTimeout         = time.Minute
+)
+
+var (
+	errExecutorBusy    = errors.New("too many tasks in progress")
+	errExecutorStopped = errors.New("shutting down")
+)
+
+// task is a unit of work run by an executor
+type task struct {
+	Name string
+
+	// Channel where a panic of the task is reported, besides the
+	// notify channel, optional
+	Channel string
+
+	Run func(ctx context.Context) error
+}
+
+// executor runs tasks with a bounded pool of workers, tasks that don't fit
+// in its queue are rejected right away so that callers can tell the user
+type executor struct {
+	name     string
+	timeout  time.Duration
+	tasks    chan *task
+	inFlight int64
+
+	// pending counts the tasks that were submitted and didn't finish yet,
+	// the lock guards it against submissions while the executor drains
+	mu       sync.RWMutex
+	stopping bool
+	pending  sync.WaitGroup
+
+	api           *slack.Client
+	notifyChannel string
+}
+
+// jobExecutor runs releases and workflows, eventExecutor handles the
+// Slack events, both are set up by main()
+var (
+	jobExecutor   *executor
+	eventExecutor *executor
+)
+
+func newExecutor(name string, workers, queue int, timeout time.Duration,
+	api *slack.Client, notifyChannel string) *executor {
+	e := &executor{
+		name:          name,
+		timeout:       timeout,
+		tasks:         make(chan *task, queue),
+		api:           api,
+		notifyChannel: notifyChannel,
+	}
+
+	for i := 0; i < workers; i++ {
+		go e.work()
+	}
+	logger.Infow("executor started", "name", name, "workers", workers, "queue", queue, "timeout", timeout)
+	return e
+}
+
+// Submit queues the task, it never blocks, if the executor is busy it
+// returns errExecutorBusy and errExecutorStopped once it started draining
+func (e *executor) Submit(t *task) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.stopping {
+		return errors.Wrapf(errExecutorStopped, "unable to run %s", t.Name)
+	}
+
+	e.pending.Add(1)
+	select {
+	case e.tasks <- t:
+		logger.Debugw("task submitted", "executor", e.name, "task", t.Name)
+		return nil
+	default:
+		e.pending.Done()
+		logger.Warnw("executor busy, task rejected",
+			"executor", e.name, "task", t.Name, "queued", len(e.tasks))
+		return errors.Wrapf(errExecutorBusy, "unable to run %s", t.Name)
+	}
+}
+
+// Drain stops accepting tasks and waits for the submitted ones to finish,
+// it gives up when the context is done, the tasks keep running though
+func (e *executor) Drain(ctx context.Context) error {
+	e.mu.Lock()
+	e.stopping = true
+	e.mu.Unlock()
+
+	logger.Infow("draining executor", "executor", e.name, "in_flight", e.InFlight(), "queued", len(e.tasks))
+
+	done := make(chan struct{})
+	go func() {
+		e.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Infow("executor drained", "executor", e.name)
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "unable to drain executor %s, %d tasks in progress", e.name, e.InFlight())
+	}
+}
+
+// InFlight returns the number of tasks running right now
+func (e *executor) InFlight() int {
+	return int(atomic.LoadInt64(&e.inFlight))
+}
+
+func (e *executor) work() {
+	for t := range e.tasks {
+		e.run(t)
+		e.pending.Done()
+	}
+}
+
+// run runs the task with the timeout of the executor, a panic in the
+// task is reported to Slack instead of crashing ally
+func (e *executor) run(t *task) {
+	atomic.AddInt64(&e.inFlight, 1)
+	defer atomic.AddInt64(&e.inFlight, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorw("task panicked",
+				"executor", e.name, "task", t.Name, "panic", r, "stack", stack())
+
+			msg := fmt.Sprintf(":boom: Something went really wrong while running *%s*, "+
+				"the team has been notified.", t.Name)
+			if t.Channel != "" && t.Channel != e.notifyChannel {
+				notifySlackChannel(context.Background(), e.api, t.Channel, msg)
+			}
+			notifySlackChannel(context.Background(), e.api, e.notifyChannel,
+				fmt.Sprintf(":boom: Task *%s* panicked: `%v`", t.Name, r))
+		}
+	}()
+
+	started := time.Now()
+	if err := t.Run(ctx); err != nil {
+		logger.Errorw("task failed",
+			"executor", e.name, "task", t.Name, "elapsed", time.Since(started), "error", err)
+		return
+	}
+	logger.Debugw("task finished", "executor", e.name, "task", t.Name, "elapsed", time.Since(started))
+}
+
+// rejectedMessage is shown to users when a task is rejected by an executor
+func rejectedMessage(err error, what string) string {
+	if errors.Is(err, errExecutorStopped) {
+		return fmt.Sprintf(":recycle: I'm restarting and can't %s right now, try again in a minute.", what)
+	}
+	return fmt.Sprintf(":traffic_light: I'm too busy to %s right now, try again in a few minutes.", what)
+}
+
+// stack returns the stack trace of the current goroutine
+func stack() string {
+	buf := make([]byte, 64<<10)
+	return string(buf[:runtime.Stack(buf, false)])
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func (config *c) verifyGithubConfig() error {
+	ghToken := os.Getenv("GH_TOKEN")
+	if ghToken == "" {
+		return errors.New("GH_TOKEN must be set")
+	}
+	return nil
+}
+
+const (
+	// how long we wait for Github to create the run of a dispatched workflow
+	githubRunResolveTimeout  = 2 * time.Minute
+	githubRunResolveInterval = 5 * time.Second
+
+	// runs created slightly before the dispatch are still considered to
+	// account for clock differences between ally and Github
+	githubRunClockSkew = 30 * time.Second
+
+	// a claim only matters while a dispatch can still match its run, that
+	// is during the resolve timeout plus the clock skew on both sides
+	githubClaimLifetime = githubRunResolveTimeout + 2*githubRunClockSkew
+)
+
+// workflow dispatches only accept a branch or a tag
+var errGithubShaNotSupported = errors.New("Github workflows can only run from a branch or a tag, not a commit")
+
+// without a correlation input, a dispatch can't tell its run apart from
+// other runs of the workflow created at the same time
+var errGithubRunAmbiguous = errors.New("several runs could have been created by the dispatch")
+
+// githubBackend runs Github workflows via the Github API
+type githubBackend struct{}
+
+// githubClaimedRuns are the workflow runs that were already matched to a
+// dispatch, so that two dispatches of the same workflow at the same time
+// don't end up following the same run, claims are kept with the time
+// they were made
+var githubClaimedRuns = struct {
+	sync.Mutex
+	ids map[int64]time.Time
+}{ids: map[int64]time.Time{}}
+
+func newGithubBackend() *githubBackend {
+	return &githubBackend{}
+}
+
+func (b *githubBackend) Name() string {
+	return BackendGithub
+}
+
+// Trigger dispatches a workflow and, since the Github API doesn't return
+// the ID of the run that was created, it tries to find the run by looking
+// at the runs created after the dispatch. If the run can't be found, the
+// returned run won't have an ID
+func (b *githubBackend) Trigger(ctx context.Context, req *triggerRequest) (_ *backendRun, err error) {
+	defer func() { recordBackendRequest(BackendGithub, "trigger", err) }()
+
+	if req.Repo == "" {
+		return nil, errors.New("missing Github repository")
+	}
+	if req.Sha != "" {
+		return nil, errGithubShaNotSupported
+	}
+
+	client, repo, err := b.clientFor(req.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs, err := githubInputs(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// when the workflow accepts a correlation input, we pass a unique ID
+	// that the workflow is expected to include in its run-name
+	var correlationID string
+	if req.CorrelationInput != "" {
+		correlationID = newRandomID()
+		inputs[req.CorrelationInput] = correlationID
+	}
+
+	ref := req.Ref
+	if ref == "" {
+		ref, err = client.DefaultBranch(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dispatchedAt := time.Now()
+	if err := client.DispatchWorkflow(ctx, repo, req.Pipeline, ref, inputs); err != nil {
+		return nil, err
+	}
+
+	run := &backendRun{Backend: BackendGithub, Repo: req.Repo}
+	ghRun, err := b.resolveRun(ctx, client, repo, req.Pipeline, ref, correlationID, dispatchedAt)
+	if err != nil {
+		logger.Warnw("unable to find the run of the dispatched workflow",
+			"repo", repo, "workflow", req.Pipeline, "error", err)
+		return run, nil
+	}
+
+	run.ID = strconv.FormatInt(ghRun.ID, 10)
+	run.URL = ghRun.HTMLURL
+	return run, nil
+}
+
+// Describe returns the request to the Github API that dispatches the
+// workflow, the values of secret inputs are redacted
+func (b *githubBackend) Describe(req *triggerRequest) (string, error) {
+	if req.Repo == "" {
+		return "", errors.New("missing Github repository")
+	}
+	if req.Sha != "" {
+		return "", errGithubShaNotSupported
+	}
+
+	client, repo, err := b.clientFor(req.Repo)
+	if err != nil {
+		return "", err
+	}
+
+	redacted := *req
+	redacted.Variables = redactor.RedactVariables(req.Variables)
+	inputs, err := githubInputs(&redacted)
+	if err != nil {
+		return "", err
+	}
+	if req.CorrelationInput != "" {
+		inputs[req.CorrelationInput] = "(unique ID)"
+	}
+
+	ref := req.Ref
+	if ref == "" {
+		ref = "(default branch)"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"ref": ref, "inputs": inputs})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("POST %s%s/dispatches %s", client.baseURL, workflowPath(repo, req.Pipeline), body), nil
+}
+
+// githubInputs returns the inputs of the workflow from the variables of the request
+func githubInputs(req *triggerRequest) (map[string]string, error) {
+	inputs := make(map[string]string, len(req.Variables))
+	for _, v := range req.Variables {
+		key, value, err := splitVariable(v)
+		if err != nil {
+			return nil, err
+		}
+		inputs[key] = value
+	}
+	return inputs, nil
+}
+
+// resolveRun finds the run created by a workflow dispatch, if a correlation ID
+// was provided the run is matched by its name, otherwise we pick the only
+// run created after the dispatch that no one else has claimed and give up
+// when there is more than one
+func (b *githubBackend) resolveRun(ctx context.Context, client *githubClient,
+	repo, workflow, ref, correlationID string, dispatchedAt time.Time) (*githubWorkflowRun, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, githubRunResolveTimeout)
+	defer cancel()
+
+	since := dispatchedAt.Add(-githubRunClockSkew)
+	filter := githubRunsFilter{
+		Event:   "workflow_dispatch",
+		Branch:  ref,
+		Created: ">=" + since.UTC().Format(time.RFC3339),
+		PerPage: 20,
+	}
+
+	ticker := time.NewTicker(githubRunResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "workflow run not found")
+		case <-ticker.C:
+		}
+
+		runs, err := client.ListWorkflowRuns(ctx, repo, workflow, filter)
+		if err != nil {
+			logger.Warnw("unable to list workflow runs", "repo", repo, "workflow", workflow, "error", err)
+			continue
+		}
+
+		run, err := claimGithubRun(runs, correlationID, since)
+		if err != nil {
+			return nil, err
+		}
+		if run != nil {
+			logger.Infow("workflow run found",
+				"repo", repo, "workflow", workflow, "id", run.ID, "url", run.HTMLURL)
+			return run, nil
+		}
+	}
+}
+
+// claimGithubRun picks a run from the provided list and marks it as claimed,
+// the claims that no dispatch can match anymore are forgotten. Without a
+// correlation ID, several unclaimed runs make the match ambiguous
+func claimGithubRun(runs []githubWorkflowRun, correlationID string, since time.Time) (*githubWorkflowRun, error) {
+	githubClaimedRuns.Lock()
+	defer githubClaimedRuns.Unlock()
+
+	now := time.Now()
+	for id, claimed := range githubClaimedRuns.ids {
+		if now.Sub(claimed) > githubClaimLifetime {
+			delete(githubClaimedRuns.ids, id)
+		}
+	}
+
+	var match *githubWorkflowRun
+	for i, run := range runs {
+		if _, claimed := githubClaimedRuns.ids[run.ID]; claimed || run.CreatedAt.Before(since) {
+			continue
+		}
+
+		if correlationID != "" {
+			if strings.Contains(run.DisplayTitle, correlationID) || strings.Contains(run.Name, correlationID) {
+				match = &runs[i]
+				break
+			}
+			continue
+		}
+
+		if match != nil {
+			return nil, errGithubRunAmbiguous
+		}
+		match = &runs[i]
+	}
+
+	if match != nil {
+		githubClaimedRuns.ids[match.ID] = now
+	}
+	return match, nil
+}
+
+func (b *githubBackend) Status(ctx context.Context, run *backendRun) (_ *runStatus, err error) {
+	defer func() { recordBackendRequest(BackendGithub, "status", err) }()
+
+	client, repo, id, err := b.clientForRun(run)
+	if err != nil {
+		return nil, err
+	}
+
+	ghRun, err := client.GetWorkflowRun(ctx, repo, id)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &runStatus{
+		State:   githubRunState(ghRun.Status, ghRun.Conclusion),
+		URL:     ghRun.HTMLURL,
+		Started: ghRun.RunStartedAt,
+	}
+	if status.Done() {
+		status.Finished = ghRun.UpdatedAt
+	}
+
+	// the jobs are not critical, if we can't get them we still
+	// know the overall status of the run
+	jobs, err := client.ListWorkflowRunJobs(ctx, repo, id)
+	if err != nil {
+		logger.Warnw("unable to get github workflow run jobs", "run", run.ID, "error", err)
+		return status, nil
+	}
+
+	for _, job := range jobs {
+		for _, step := range job.Steps {
+			name := job.Name + " / " + step.Name
+			if step.Status == "in_progress" && status.Step == "" {
+				status.Step = name
+			}
+			if step.Conclusion == "failure" && status.FailedStep == "" {
+				status.FailedStep = name
+			}
+		}
+	}
+	return status, nil
+}
+
+func (b *githubBackend) Cancel(ctx context.Context, run *backendRun) (err error) {
+	defer func() { recordBackendRequest(BackendGithub, "cancel", err) }()
+
+	client, repo, id, err := b.clientForRun(run)
+	if err != nil {
+		return err
+	}
+	return client.CancelWorkflowRun(ctx, repo, id)
+}
+
+// clientFor returns a client for the host of the provided [HOST/]OWNER/REPO
+// repository, together with the OWNER/REPO part
+func (b *githubBackend) clientFor(repository string) (*githubClient, string, error) {
+	host, repo, err := splitGithubRepo(repository)
+	if err != nil {
+		return nil, "", err
+	}
+	return newGithubClientFromEnv(host), repo, nil
+}
+
+func (b *githubBackend) clientForRun(run *backendRun) (*githubClient, string, int64, error) {
+	if run.ID == "" {
+		return nil, "", 0, errors.New("unknown Github workflow run")
+	}
+
+	id, err := strconv.ParseInt(run.ID, 10, 64)
+	if err != nil {
+		return nil, "", 0, errors.Wrapf(err, "invalid Github workflow run ID '%s'", run.ID)
+	}
+
+	client, repo, err := b.clientFor(run.Repo)
+	return client, repo, id, err
+}
+
+// githubRunState translates the status and conclusion of a Github workflow
+// run into a run state
+func githubRunState(status, conclusion string) string {
+	if status != "completed" {
+		if status == "in_progress" {
+			return RunStateRunning
+		}
+		return RunStatePending
+	}
+
+	switch conclusion {
+	case "success":
+		return RunStateSuccess
+	case "cancelled":
+		return RunStateCancelled
+	default:
+		return RunStateFailed
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGithubHost   = "github.com"
+	defaultGithubAPIURL = "https://api.github.com"
+)
+
+var (
+	// errors that can be matched with errors.Is() to know why the
+	// Github API rejected a request
+	errGithubNotFound         = errors.New("not found")
+	errGithubWorkflowNotFound = errors.New("workflow not found")
+	errGithubRefNotFound      = errors.New("ref not found")
+	errGithubInputRejected    = errors.New("input not accepted")
+)
+
+// githubClient is a minimal client of the Github REST API
+//
+// https://docs.github.com/en/rest/actions
+type githubClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// githubAPIError is returned when the Github API responds with an error
+type githubAPIError struct {
+	StatusCode       int                 `json:"-"`
+	Message          string              `json:"message"`
+	DocumentationURL string              `json:"documentation_url"`
+	Errors           []githubErrorDetail `json:"errors"`
+
+	// kind is one of the errGithub* errors, can be nil
+	kind error
+}
+
+type githubErrorDetail struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+func (e *githubAPIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	for _, detail := range e.Errors {
+		if detail.Message != "" {
+			msg = fmt.Sprintf("%s (%s)", msg, detail.Message)
+		}
+	}
+	if e.kind != nil {
+		return fmt.Sprintf("github api error: %s: %s", e.kind, msg)
+	}
+	return fmt.Sprintf("github api error: %d %s", e.StatusCode, msg)
+}
+
+func (e *githubAPIError) Unwrap() error {
+	return e.kind
+}
+
+// githubWorkflowRun is a single run of a Github workflow
+type githubWorkflowRun struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	DisplayTitle string    `json:"display_title"`
+	Event        string    `json:"event"`
+	Status       string    `json:"status"`
+	Conclusion   string    `json:"conclusion"`
+	HeadBranch   string    `json:"head_branch"`
+	HTMLURL      string    `json:"html_url"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	RunStartedAt time.Time `json:"run_started_at"`
+	Actor        struct {
+		Login string `json:"login"`
+	} `json:"actor"`
+}
+
+// githubJob is a job of a workflow run
+type githubJob struct {
+	ID          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Status      string       `json:"status"`
+	Conclusion  string       `json:"conclusion"`
+	HTMLURL     string       `json:"html_url"`
+	StartedAt   *time.Time   `json:"started_at"`
+	CompletedAt *time.Time   `json:"completed_at"`
+	Steps       []githubStep `json:"steps"`
+}
+
+// githubStep is a step of a job
+type githubStep struct {
+	Name       string `json:"name"`
+	Number     int    `json:"number"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+}
+
+// githubRunsFilter filters the list of workflow runs
+type githubRunsFilter struct {
+	Event   string
+	Branch  string
+	Actor   string
+	Created string
+	PerPage int
+}
+
+func newGithubClient(baseURL, token string, httpClient *http.Client) *githubClient {
+	if baseURL == "" {
+		baseURL = defaultGithubAPIURL
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &githubClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    httpClient,
+	}
+}
+
+// newGithubClientFromEnv returns a client for the provided host authenticated
+// with the GH_TOKEN environment variable, for Github Enterprise hosts the
+// variable GH_ENTERPRISE_TOKEN has precedence. An empty host means the host
+// configured via GH_HOST, or github.com if not set
+func newGithubClientFromEnv(host string) *githubClient {
+	if host == "" {
+		host = os.Getenv("GH_HOST")
+	}
+
+	if host == "" || host == defaultGithubHost {
+		return newGithubClient(os.Getenv("GITHUB_API_URL"), os.Getenv("GH_TOKEN"), nil)
+	}
+
+	token := os.Getenv("GH_ENTERPRISE_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	return newGithubClient(fmt.Sprintf("https://%s/api/v3", host), token, nil)
+}
+
+// splitGithubRepo splits a repository in the format [HOST/]OWNER/REPO into
+// the host (empty if not provided) and the OWNER/REPO part
+func splitGithubRepo(repo string) (string, string, error) {
+	parts := strings.Split(strings.Trim(repo, "/"), "/")
+	for _, p := range parts {
+		if p == "" {
+			return "", "", errors.Errorf("malformed repository '%s'", repo)
+		}
+	}
+
+	switch len(parts) {
+	case 2:
+		return "", strings.Join(parts, "/"), nil
+	case 3:
+		return parts[0], strings.Join(parts[1:], "/"), nil
+	default:
+		return "", "", errors.Errorf("malformed repository '%s', expected format [HOST/]OWNER/REPO", repo)
+	}
+}
+
+// DefaultBranch returns the default branch of the provided repository
+func (gh *githubClient) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var out struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := gh.do(ctx, http.MethodGet, "/repos/"+repo, nil, &out); err != nil {
+		return "", errors.Wrapf(err, "unable to get repository %s", repo)
+	}
+	return out.DefaultBranch, nil
+}
+
+// DispatchWorkflow triggers a workflow_dispatch event for the provided workflow,
+// the workflow can either be its ID or its file name
+func (gh *githubClient) DispatchWorkflow(ctx context.Context, repo, workflow, ref string, inputs map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{"ref": ref, "inputs": inputs})
+	if err != nil {
+		return err
+	}
+
+	err = gh.do(ctx, http.MethodPost, workflowPath(repo, workflow)+"/dispatches", bytes.NewReader(body), nil)
+
+	var apiErr *githubAPIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound:
+			apiErr.kind = errGithubWorkflowNotFound
+		case strings.Contains(strings.ToLower(apiErr.Message), "no ref found"):
+			apiErr.kind = errGithubRefNotFound
+		case apiErr.StatusCode == http.StatusUnprocessableEntity:
+			apiErr.kind = errGithubInputRejected
+		}
+	}
+	return errors.Wrapf(err, "unable to dispatch workflow %s in %s", workflow, repo)
+}
+
+// ListWorkflowRuns returns the most recent runs of the provided workflow
+func (gh *githubClient) ListWorkflowRuns(ctx context.Context, repo, workflow string, filter githubRunsFilter) ([]githubWorkflowRun, error) {
+	query := url.Values{}
+	if filter.Event != "" {
+		query.Set("event", filter.Event)
+	}
+	if filter.Branch != "" {
+		query.Set("branch", filter.Branch)
+	}
+	if filter.Actor != "" {
+		query.Set("actor", filter.Actor)
+	}
+	if filter.Created != "" {
+		query.Set("created", filter.Created)
+	}
+	if filter.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(filter.PerPage))
+	}
+
+	var out struct {
+		WorkflowRuns []githubWorkflowRun `json:"workflow_runs"`
+	}
+	err := gh.do(ctx, http.MethodGet, workflowPath(repo, workflow)+"/runs?"+query.Encode(), nil, &out)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list runs of workflow %s in %s", workflow, repo)
+	}
+	return out.WorkflowRuns, nil
+}
+
+// GetWorkflowRun returns the workflow run with the provided ID
+func (gh *githubClient) GetWorkflowRun(ctx context.Context, repo string, id int64) (*githubWorkflowRun, error) {
+	var run githubWorkflowRun
+	if err := gh.do(ctx, http.MethodGet, runPath(repo, id), nil, &run); err != nil {
+		return nil, errors.Wrapf(err, "unable to get workflow run %d in %s", id, repo)
+	}
+	return &run, nil
+}
+
+// ListWorkflowRunJobs returns the jobs, including their steps, of a workflow run
+func (gh *githubClient) ListWorkflowRunJobs(ctx context.Context, repo string, id int64) ([]githubJob, error) {
+	var out struct {
+		Jobs []githubJob `json:"jobs"`
+	}
+	if err := gh.do(ctx, http.MethodGet, runPath(repo, id)+"/jobs?per_page=100", nil, &out); err != nil {
+		return nil, errors.Wrapf(err, "unable to list jobs of workflow run %d in %s", id, repo)
+	}
+	return out.Jobs, nil
+}
+
+// GetWorkflow returns an error if the workflow doesn't exist in the
+// repository, the workflow can either be its ID or its file name
+func (gh *githubClient) GetWorkflow(ctx context.Context, repo, workflow string) error {
+	err := gh.do(ctx, http.MethodGet, workflowPath(repo, workflow), nil, nil)
+	return errors.Wrapf(err, "unable to get workflow %s in %s", workflow, repo)
+}
+
+// RateLimit returns the number of core API requests left for the token,
+// it is also a cheap way to check that the token is valid
+func (gh *githubClient) RateLimit(ctx context.Context) (int, error) {
+	var out struct {
+		Resources struct {
+			Core struct {
+				Remaining int `json:"remaining"`
+			} `json:"core"`
+		} `json:"resources"`
+	}
+	if err := gh.do(ctx, http.MethodGet, "/rate_limit", nil, &out); err != nil {
+		return 0, errors.Wrap(err, "unable to get rate limit")
+	}
+	return out.Resources.Core.Remaining, nil
+}
+
+// CancelWorkflowRun cancels a workflow run that is in progress
+func (gh *githubClient) CancelWorkflowRun(ctx context.Context, repo string, id int64) error {
+	err := gh.do(ctx, http.MethodPost, runPath(repo, id)+"/cancel", nil, nil)
+	return errors.Wrapf(err, "unable to cancel workflow run %d in %s", id, repo)
+}
+
+func workflowPath(repo, workflow string) string {
+	return fmt.Sprintf("/repos/%s/actions/workflows/%s", repo, url.PathEscape(workflow))
+}
+
+func runPath(repo string, id int64) string {
+	return fmt.Sprintf("/repos/%s/actions/runs/%d", repo, id)
+}
+
+func (gh *githubClient) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	if gh.token == "" {
+		return errors.New("GH_TOKEN must be set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, gh.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+gh.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	logger.Debugw("github api request", "method", method, "path", path)
+	res, err := gh.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to read response body")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := &githubAPIError{}
+		if err := json.Unmarshal(data, apiErr); err != nil {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		apiErr.StatusCode = res.StatusCode
+		if res.StatusCode == http.StatusNotFound {
+			apiErr.kind = errGithubNotFound
+		}
+		return apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeGithub serves the Github API endpoints used by ally
+func fakeGithub(t *testing.T, handler http.HandlerFunc) *githubClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret-token" {
+			t.Errorf("expected the token in the Authorization header, got '%s'", got)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return newGithubClient(server.URL+"/", "secret-token", server.Client())
+}
+
+func TestGithubDispatchWorkflow(t *testing.T) {
+	client := fakeGithub(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/repos/lacework/go-sdk/actions/workflows/release.yml/dispatches" {
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		var body struct {
+			Ref    string            `json:"ref"`
+			Inputs map[string]string `json:"inputs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Ref != "main" || body.Inputs["version"] != "v1.2.3" {
+			t.Errorf("unexpected dispatch %+v", body)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	err := client.DispatchWorkflow(context.Background(), "lacework/go-sdk", "release.yml", "main",
+		map[string]string{"version": "v1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGithubDispatchWorkflowErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{"workflow not found", http.StatusNotFound,
+			`{"message":"Not Found"}`, errGithubWorkflowNotFound},
+		{"ref not found", http.StatusUnprocessableEntity,
+			`{"message":"No ref found for: nope"}`, errGithubRefNotFound},
+		{"input rejected", http.StatusUnprocessableEntity,
+			`{"message":"Unexpected inputs provided: [\"bump\"]"}`, errGithubInputRejected},
+		{"server error", http.StatusBadGateway, "upstream down", nil},
+	}
+
+	kinds := []error{errGithubWorkflowNotFound, errGithubRefNotFound, errGithubInputRejected}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fakeGithub(t, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+			err := client.DispatchWorkflow(context.Background(), "lacework/go-sdk", "release.yml", "main", nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, kind := range kinds {
+				if got := errors.Is(err, kind); got != (kind == tc.want) {
+					t.Errorf("errors.Is(%v, %v) = %t", err, kind, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubAPIErrorMessage(t *testing.T) {
+	client := fakeGithub(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"message":"Validation Failed","errors":[{"message":"ref is invalid"}]}`)
+	})
+	err := client.DispatchWorkflow(context.Background(), "lacework/go-sdk", "release.yml", "main", nil)
+	if err == nil || !strings.Contains(err.Error(), "Validation Failed (ref is invalid)") {
+		t.Errorf("expected the details of the error in its message, got %v", err)
+	}
+}
+
+func TestGithubNotFound(t *testing.T) {
+	client := fakeGithub(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"message":"Not Found"}`)
+	})
+	_, err := client.GetWorkflowRun(context.Background(), "lacework/go-sdk", 42)
+	if !errors.Is(err, errGithubNotFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if errors.Is(err, errGithubWorkflowNotFound) {
+		t.Errorf("only dispatches report a missing workflow, got %v", err)
+	}
+}
+
+func TestGithubMissingToken(t *testing.T) {
+	client := newGithubClient("http://127.0.0.1:0", "", nil)
+	if _, err := client.GetWorkflowRun(context.Background(), "lacework/go-sdk", 42); err == nil ||
+		!strings.Contains(err.Error(), "GH_TOKEN") {
+		t.Errorf("expected an error about GH_TOKEN, got %v", err)
+	}
+}
+
+func TestClaimGithubRun(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	runs := []githubWorkflowRun{
+		{ID: 1, CreatedAt: since.Add(-time.Hour)},
+		{ID: 2, CreatedAt: since.Add(time.Second), DisplayTitle: "release abc123"},
+		{ID: 3, CreatedAt: since.Add(2 * time.Second), DisplayTitle: "release def456"},
+	}
+
+	// without a correlation ID, two new runs could be ours
+	if _, err := claimGithubRun(runs, "", since); !errors.Is(err, errGithubRunAmbiguous) {
+		t.Errorf("expected an ambiguous match, got %v", err)
+	}
+
+	run, err := claimGithubRun(runs, "def456", since)
+	if err != nil || run == nil || run.ID != 3 {
+		t.Fatalf("expected run 3, got %+v, %v", run, err)
+	}
+
+	// the claimed run is left out, the one remaining is the only match
+	run, err = claimGithubRun(runs, "", since)
+	if err != nil || run == nil || run.ID != 2 {
+		t.Fatalf("expected run 2, got %+v, %v", run, err)
+	}
+
+	run, err = claimGithubRun(runs, "", since)
+	if err != nil || run != nil {
+		t.Errorf("expected no run left to claim, got %+v, %v", run, err)
+	}
+}
@@ -5,14 +5,13 @@ go 1.18
 require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/lacework/go-sdk v0.41.1
-	github.com/mitchellh/go-homedir v1.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/slack-go/slack v0.11.3
+	go.uber.org/zap v1.21.0
 )
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
-	go.uber.org/zap v1.21.0 // indirect
 )
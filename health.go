@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHTTPAddr = ":8080"
+
+	// credentials are checked in the background so that probes are cheap
+	credentialsCheckInterval = time.Minute
+	credentialsCheckTimeout  = 10 * time.Second
+
+	// socketmode reconnects within seconds, a connection that stays down
+	// longer than this means that ally is wedged and must be restarted
+	slackLivenessTimeout = 5 * time.Minute
+)
+
+// Version of ally, set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+var (
+	startedAt      = time.Now()
+	slackConnected int32
+
+	// when the socketmode connection went down, in unix nanoseconds, ally
+	// is not connected until it says hello to Slack
+	slackDisconnectedAt = startedAt.UnixNano()
+)
+
+// setSlackConnected records the state of the socketmode connection
+func setSlackConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	if atomic.SwapInt32(&slackConnected, v) != v {
+		logger.Infow("slack connection changed", "connected", connected)
+		if connected {
+			atomic.StoreInt64(&slackDisconnectedAt, 0)
+		} else {
+			atomic.StoreInt64(&slackDisconnectedAt, time.Now().UnixNano())
+		}
+	}
+}
+
+func isSlackConnected() bool {
+	return atomic.LoadInt32(&slackConnected) == 1
+}
+
+// slackDisconnectedFor returns how long the socketmode connection has been
+// down, zero when it is up
+func slackDisconnectedFor() time.Duration {
+	since := atomic.LoadInt64(&slackDisconnectedAt)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// healthCheck is the result of one of the readiness checks
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newHealthCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// credentialChecks keeps the result of the last check of the Codefresh
+// and Github credentials
+var credentialChecks = struct {
+	sync.Mutex
+	checkedAt time.Time
+	results   []healthCheck
+}{}
+
+// checkCredentials verifies that the Codefresh and Github credentials work
+func (config *c) checkCredentials(ctx context.Context) []healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, credentialsCheckTimeout)
+	defer cancel()
+
+	results := []healthCheck{}
+	if config.UsesBackend(BackendCodefresh) {
+		_, err := newCodefreshClientFromEnv().CurrentUser(ctx)
+		results = append(results, newHealthCheck("codefresh_credentials", err))
+	}
+
+	_, err := newGithubClientFromEnv("").RateLimit(ctx)
+	results = append(results, newHealthCheck("github_credentials", err))
+
+	for _, r := range results {
+		if !r.OK {
+			logger.Warnw("credentials check failed", "check", r.Name, "error", r.Error)
+		}
+	}
+	return results
+}
+
+// watchCredentials checks the credentials needed by the current config
+// periodically until the context is done
+func watchCredentials(ctx context.Context) {
+	ticker := time.NewTicker(credentialsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		results := currentConfig().checkCredentials(ctx)
+
+		credentialChecks.Lock()
+		credentialChecks.results = results
+		credentialChecks.checkedAt = time.Now()
+		credentialChecks.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readinessChecks returns the checks that must pass before ally can take commands
+func (config *c) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{Name: "config_loaded", OK: config != nil && config.hash != ""},
+		{Name: "slack_connected", OK: isSlackConnected()},
+		{Name: "not_shutting_down", OK: !isShuttingDown()},
+	}
+
+	credentialChecks.Lock()
+	defer credentialChecks.Unlock()
+	if credentialChecks.checkedAt.IsZero() {
+		return append(checks, healthCheck{Name: "credentials", Error: "not checked yet"})
+	}
+	return append(checks, credentialChecks.results...)
+}
+
+// jobDiagnostics is the summary of a job in progress
+type jobDiagnostics struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target"`
+	Requester string    `json:"requester,omitempty"`
+	Backend   string    `json:"backend"`
+	State     string    `json:"state"`
+	Step      string    `json:"step,omitempty"`
+	RunURL    string    `json:"run_url,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+// diagnostics returns what is useful to know about this ally instance
+func (config *c) diagnostics() map[string]interface{} {
+	inProgress := []jobDiagnostics{}
+	for _, j := range jobs.Active() {
+		s := j.Snapshot()
+		d := jobDiagnostics{
+			ID: s.ID, Kind: s.Kind, Target: s.Target, Requester: s.Requester,
+			Backend: s.Backend, State: s.State, Step: s.Step, StartedAt: s.StartedAt,
+		}
+		if s.Run != nil {
+			d.RunURL = s.Run.URL
+		}
+		inProgress = append(inProgress, d)
+	}
+
+	executors := map[string]interface{}{}
+	for _, e := range []*executor{eventExecutor, jobExecutor} {
+		if e != nil {
+			executors[e.name] = map[string]int{"in_flight": e.InFlight(), "queued": len(e.tasks)}
+		}
+	}
+
+	return map[string]interface{}{
+		"version":         Version,
+		"started_at":      startedAt.UTC(),
+		"uptime":          time.Since(startedAt).Round(time.Second).String(),
+		"config_path":     config.path,
+		"config_hash":     config.hash,
+		"slack_connected": isSlackConnected(),
+		"shutting_down":   isShuttingDown(),
+		"dry_run":         dryRun,
+		"executors":       executors,
+		"jobs":            inProgress,
+	}
+}
+
+// healthServer serves the liveness, readiness and diagnostics endpoints
+var healthServer *http.Server
+
+func newHealthServer(config *c) *http.Server {
+	mux := http.NewServeMux()
+
+	// liveness, the process is up and its connection to Slack didn't stay
+	// down for long. ECS restarts ally when this fails, the releases in
+	// progress are drained or resumed by the next ally
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if down := slackDisconnectedFor(); down > slackLivenessTimeout {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"status": "slack disconnected for " + down.Round(time.Second).String(),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	// readiness, ally is connected to Slack and can release projects, for
+	// load balancers only: a short Slack reconnect or a backend outage must
+	// not get ally killed in the middle of a release
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		checks := currentConfig().readinessChecks()
+		ready := true
+		for _, check := range checks {
+			ready = ready && check.OK
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+	})
+
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	mux.HandleFunc("/diagnostics", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, currentConfig().diagnostics())
+	})
+
+	return &http.Server{
+		Addr:              config.ListenAddr(),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// startHealthServer serves the health endpoints in the background
+func startHealthServer(config *c) {
+	healthServer = newHealthServer(config)
+	go watchCredentials(context.Background())
+
+	go func() {
+		logger.Infow("health server listening", "addr", healthServer.Addr)
+		if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("health server stopped", "addr", healthServer.Addr, "error", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorw("unable to write http response", "error", err)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// States of a job, the final states of a job are the same
+	// as the ones of a run plus JobError and JobUntracked
+	JobPending    = "pending"
+	JobTriggering = "triggering"
+	JobRunning    = "running"
+	JobError      = "error"
+
+	// JobUntracked is a job whose run was triggered but couldn't be found,
+	// so its outcome is unknown
+	JobUntracked = "untracked"
+
+	// finished jobs are kept on disk for a while to be inspected
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// job is a release (or workflow run) requested by a user, it is persisted
+// on disk so that ally can pick it up again after a restart
+type job struct {
+	mu sync.Mutex
+
+	ID        string   `json:"id"`
+	Kind      string   `json:"kind"`
+	Target    string   `json:"target"`
+	Requester string   `json:"requester,omitempty"`
+	Approvers []string `json:"approvers,omitempty"`
+
+	// Backend that runs the job and the run it created
+	Backend  string      `json:"backend"`
+	Pipeline string      `json:"pipeline"`
+	Run      *backendRun `json:"run,omitempty"`
+
+	// Variables are redacted, secrets never make it to disk
+	Variables []string `json:"variables,omitempty"`
+
+	State       string `json:"state"`
+	Step        string `json:"step,omitempty"`
+	Error       string `json:"error,omitempty"`
+	CancelledBy string `json:"cancelled_by,omitempty"`
+
+	// Slack message that reports the progress of the job
+	Channel   string          `json:"channel,omitempty"`
+	Timestamp string          `json:"timestamp,omitempty"`
+	Messages  releaseMessages `json:"messages"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	// the request with the real values of the variables, only in memory
+	request *triggerRequest
+}
+
+// newJob returns a job that runs the provided request on the backend
+func newJob(kind, target, requester string, approvers []string,
+	backend string, req *triggerRequest, msgs releaseMessages) *job {
+	return &job{
+		ID:        newRandomID(),
+		Kind:      kind,
+		Target:    target,
+		Requester: requester,
+		Approvers: approvers,
+		Backend:   backend,
+		Pipeline:  req.Pipeline,
+		Variables: redactor.RedactVariables(req.Variables),
+		State:     JobPending,
+		Messages:  msgs,
+		CreatedAt: time.Now().UTC(),
+		request:   req,
+	}
+}
+
+// Done returns true if the job reached a final state
+func (j *job) Done() bool {
+	switch j.State {
+	case RunStateSuccess, RunStateFailed, RunStateCancelled, JobError, JobUntracked:
+		return true
+	}
+	return false
+}
+
+// update modifies the job and persists it
+func (j *job) update(fn func(*job)) {
+	j.mu.Lock()
+	fn(j)
+	j.mu.Unlock()
+	jobs.Save(j)
+}
+
+// Snapshot returns a copy of the job that is safe to read
+func (j *job) Snapshot() job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return job{
+		ID: j.ID, Kind: j.Kind, Target: j.Target,
+		Requester: j.Requester, Approvers: j.Approvers,
+		Backend: j.Backend, Pipeline: j.Pipeline, Run: j.Run,
+		Variables: j.Variables, State: j.State, Step: j.Step, Error: j.Error, CancelledBy: j.CancelledBy,
+		Channel: j.Channel, Timestamp: j.Timestamp, Messages: j.Messages,
+		CreatedAt: j.CreatedAt, StartedAt: j.StartedAt, FinishedAt: j.FinishedAt,
+	}
+}
+
+// auditEntry returns the record of the job for the audit log
+func (j *job) auditEntry() *auditEntry {
+	entry := &auditEntry{
+		Event:      AuditEventRelease,
+		Requester:  j.Requester,
+		Approvers:  j.Approvers,
+		Kind:       j.Kind,
+		Target:     j.Target,
+		Backend:    j.Backend,
+		Pipeline:   j.Pipeline,
+		Variables:  j.Variables,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+		Outcome:    j.State,
+		Details:    j.Error,
+	}
+	if j.CancelledBy != "" {
+		entry.Details = "cancelled by " + j.CancelledBy
+	}
+	if j.Run != nil {
+		entry.RunID = j.Run.ID
+		entry.RunURL = j.Run.URL
+	}
+	return entry
+}
+
+// jobStore persists jobs as JSON files in a directory
+type jobStore struct {
+	mu     sync.Mutex
+	dir    string
+	active map[string]*job
+}
+
+// jobs are the jobs of this ally instance, set up by main()
+var jobs *jobStore
+
+func openJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create jobs directory")
+	}
+	return &jobStore{dir: dir, active: map[string]*job{}}, nil
+}
+
+// Save writes the job to disk, errors are logged since they should never
+// stop a release that is in progress
+func (store *jobStore) Save(j *job) {
+	if store == nil {
+		return
+	}
+
+	snapshot := j.Snapshot()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if snapshot.Done() {
+		delete(store.active, j.ID)
+	} else {
+		store.active[j.ID] = j
+	}
+
+	if err := store.write(&snapshot); err != nil {
+		logger.Errorw("unable to save job", "id", j.ID, "error", err)
+	}
+}
+
+func (store *jobStore) write(j *job) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash never leaves
+	// a half written job behind
+	path := store.path(j.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (store *jobStore) path(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+// Load returns every job on disk, oldest first
+func (store *jobStore) Load() ([]*job, error) {
+	files, err := filepath.Glob(filepath.Join(store.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	out := []*job{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read job %s", f)
+		}
+		j := &job{}
+		if err := json.Unmarshal(data, j); err != nil {
+			logger.Errorw("ignoring malformed job", "file", f, "error", err)
+			continue
+		}
+		out = append(out, j)
+	}
+
+	sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.Before(out[k].CreatedAt) })
+	return out, nil
+}
+
+// Active returns the jobs that are in progress
+func (store *jobStore) Active() []*job {
+	if store == nil {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	out := make([]*job, 0, len(store.active))
+	for _, j := range store.active {
+		out = append(out, j)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.Before(out[k].CreatedAt) })
+	return out
+}
+
+// Prune removes finished jobs older than the retention period
+func (store *jobStore) Prune() {
+	all, err := store.Load()
+	if err != nil {
+		logger.Errorw("unable to load jobs to prune", "error", err)
+		return
+	}
+	for _, j := range all {
+		if j.Done() && time.Since(j.FinishedAt) > jobRetention {
+			if err := os.Remove(store.path(j.ID)); err != nil {
+				logger.Warnw("unable to remove old job", "id", j.ID, "error", err)
+			}
+		}
+	}
+}
+
+// runJob triggers the job on the provided backend and keeps its Slack
+// message up to date with the status of the run until it finishes
+func runJob(ctx context.Context, api *slack.Client, backend releaseBackend, j *job) error {
+	logger.Infow("triggering run",
+		"job", j.ID,
+		"backend", backend.Name(),
+		"pipeline", j.request.Pipeline,
+		"repo", j.request.Repo,
+		"ref", j.request.Ref,
+	)
+
+	j.update(func(j *job) {
+		j.State = JobTriggering
+		j.StartedAt = time.Now().UTC()
+	})
+
+	run, err := backend.Trigger(ctx, j.request)
+	if err != nil {
+		updateJobMessage(api, j, j.Messages.Failure+"\n> "+errorForSlack(err), false)
+		finishJob(j, JobError, err)
+		return err
+	}
+
+	logger.Infow("run triggered", "job", j.ID, "backend", run.Backend, "id", run.ID, "url", run.URL)
+	releasesTriggeredTotal.Inc(j.Kind, j.Target, j.Backend)
+	var cancelledBy string
+	j.update(func(j *job) {
+		j.Run = run
+		j.State = JobRunning
+		cancelledBy = j.CancelledBy
+	})
+
+	// the job was cancelled while the run was being triggered
+	if cancelledBy != "" && run.ID != "" {
+		if err := backend.Cancel(context.Background(), run); err != nil {
+			logger.Errorw("unable to cancel run", "job", j.ID, "id", run.ID, "error", err)
+		}
+	}
+
+	if run.URL != "" {
+		postSlackMessage(ctx, api, j.Channel,
+			slack.MsgOptionText(":link: Follow the run at "+run.URL, false),
+			slack.MsgOptionTS(j.Timestamp),
+		)
+	}
+
+	// dry runs tell what would have been triggered
+	if run.DryRun {
+		if call, err := backend.Describe(j.request); err == nil {
+			postSlackMessage(ctx, api, j.Channel,
+				slack.MsgOptionText(":test_tube: This is the call I would have made:\n```"+call+"```", false),
+				slack.MsgOptionTS(j.Timestamp),
+			)
+		}
+	}
+
+	// without an ID there is no way to follow the run, the trigger was
+	// accepted but that doesn't tell whether the run succeeds
+	if run.ID == "" {
+		updateJobMessage(api, j, fmt.Sprintf(
+			":grey_question: *%s* was triggered, but I couldn't find the run to follow. "+
+				"Check the status of the %s pipeline before trying again.", j.Target, strings.ToLower(j.Backend)), false)
+		finishJob(j, JobUntracked, errors.New("triggered, but the run could not be found"))
+		return nil
+	}
+
+	return followJob(ctx, api, backend, j)
+}
+
+// followJob polls the run of the job until it finishes
+func followJob(ctx context.Context, api *slack.Client, backend releaseBackend, j *job) error {
+	update := func(status *runStatus) {
+		var cancelledBy string
+		j.update(func(j *job) {
+			j.Step = status.Step
+			cancelledBy = j.CancelledBy
+		})
+		msg := renderRunStatus(j.Messages, j.Run, status, j.StartedAt)
+		if status.State == RunStateCancelled && cancelledBy != "" {
+			msg = fmt.Sprintf("%s\n_Cancelled by <@%s>_", msg, cancelledBy)
+		}
+		updateJobMessage(api, j, msg, !status.Done())
+	}
+	update(&runStatus{State: RunStatePending, URL: j.Run.URL})
+
+	status, err := trackRun(ctx, backend, j.Run, update)
+	if err != nil && ctx.Err() != nil {
+		return cancelOverdueJob(api, backend, j, err)
+	}
+	if err != nil {
+		updateJobMessage(api, j,
+			":warning: I lost track of the run, check its status at "+j.Run.URL+
+				"\n> "+errorForSlack(err), false)
+		finishJob(j, JobError, err)
+		return err
+	}
+
+	if status.State != RunStateSuccess {
+		err = errors.Errorf("run %s finished with state %s", j.Run.ID, status.State)
+	}
+	finishJob(j, status.State, err)
+	return err
+}
+
+// cancelOverdueJob stops the run of a job that outlived the timeout of the
+// executor, once we stop following it the lock of the project is released
+// and the run would keep going unnoticed
+func cancelOverdueJob(api *slack.Client, backend releaseBackend, j *job, timeoutErr error) error {
+	took := time.Since(j.StartedAt).Round(time.Minute)
+	logger.Warnw("run took too long, cancelling it", "job", j.ID, "id", j.Run.ID, "duration", took)
+
+	if err := backend.Cancel(context.Background(), j.Run); err != nil {
+		logger.Errorw("unable to cancel overdue run", "job", j.ID, "id", j.Run.ID, "error", err)
+		updateJobMessage(api, j, fmt.Sprintf(
+			":warning: The run took longer than %s and I couldn't cancel it, check its status at %s\n> %s",
+			took, j.Run.URL, errorForSlack(err)), false)
+		finishJob(j, JobError, errors.Wrap(timeoutErr, "unable to cancel the run"))
+		return err
+	}
+
+	updateJobMessage(api, j, fmt.Sprintf(
+		":alarm_clock: The run took longer than %s, I cancelled it.\n*Build:* <%s|%s>",
+		took, j.Run.URL, j.Run.ID), false)
+	finishJob(j, RunStateCancelled, errors.Wrapf(timeoutErr, "cancelled after %s", took))
+	return timeoutErr
+}
+
+// finishJob moves the job to its final state and records it in the audit log
+func finishJob(j *job, state string, err error) {
+	j.update(func(j *job) {
+		j.State = state
+		j.FinishedAt = time.Now().UTC()
+		if err != nil {
+			j.Error = err.Error()
+		}
+	})
+	audit.Record(j.auditEntry())
+
+	releasesFinishedTotal.Inc(j.Kind, j.Target, j.Backend, state)
+	if !j.StartedAt.IsZero() {
+		releaseDurationSeconds.Observe(j.FinishedAt.Sub(j.StartedAt), j.Kind, j.Target, j.Backend, state)
+	}
+}
+
+// resumeJobs picks up the jobs that were in progress when ally stopped,
+// jobs that already triggered a run are followed until they finish and
+// the rest are marked as failed since their secrets are gone
+func resumeJobs(api *slack.Client, config *c) {
+	all, err := jobs.Load()
+	if err != nil {
+		logger.Errorw("unable to load jobs", "error", err)
+		return
+	}
+
+	for _, j := range all {
+		if j.Done() {
+			continue
+		}
+
+		if j.Run == nil || j.Run.ID == "" {
+			logger.Warnw("job interrupted before its run could be followed", "id", j.ID, "target", j.Target)
+			updateJobMessage(api, j,
+				j.Messages.Failure+"\n> I was restarted before I could follow the run, "+
+					"check the status of the "+strings.ToLower(j.Backend)+" pipeline before trying again.",
+				false)
+			finishJob(j, JobError, errors.New("interrupted by a restart"))
+			continue
+		}
+
+		backend, err := newBackend(j.Backend)
+		if err != nil {
+			logger.Errorw("unable to resume job", "id", j.ID, "error", err)
+			finishJob(j, JobError, err)
+			continue
+		}
+		backend = withDryRun(backend, j.Run.DryRun)
+
+		// resumed releases keep their place in the lock of the project
+		var slot *releaseSlot
+		if p, ok := config.FindProject(j.Target); ok && j.Kind == ApprovalTargetProject {
+			key, limit := config.ConcurrencyFor(p)
+			slot = newReleaseSlot(key, j.Target, j.Requester)
+			slot.Since = j.StartedAt
+			holdRelease(slot, limit)
+		}
+
+		logger.Infow("resuming job", "id", j.ID, "target", j.Target, "run", j.Run.ID)
+		jobs.Save(j)
+		j := j
+		err = jobExecutor.Submit(&task{
+			Name:    "resumed job " + j.Target,
+			Channel: j.Channel,
+			Run: func(ctx context.Context) error {
+				if slot != nil {
+					defer freeRelease(slot)
+				}
+				return followJob(ctx, api, backend, j)
+			},
+		})
+		if err != nil {
+			if slot != nil {
+				freeRelease(slot)
+			}
+			updateJobMessage(api, j,
+				":warning: I was restarted and I'm too busy to follow the run, check its status at "+j.Run.URL, false)
+			finishJob(j, JobError, err)
+		}
+	}
+
+	jobs.Prune()
+}
+
+// updateJobMessage updates the Slack message of the job, jobs in progress
+// get a button to cancel them. The final state of a job is reported after
+// its context is done, so the update doesn't use it
+func updateJobMessage(api *slack.Client, j *job, text string, cancellable bool) {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+	}
+	if cancellable {
+		blocks = append(blocks, slack.NewActionBlock("",
+			slack.NewButtonBlockElement(SlackCancelJobAction, j.ID,
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+			).WithStyle(slack.StyleDanger).WithConfirm(slack.NewConfirmationBlockObject(
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel the run?", false, false),
+				slack.NewTextBlockObject(slack.MarkdownType, "This stops *"+j.Target+"* before it finishes.", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel it", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Keep it running", false, false),
+			)),
+		))
+	}
+	updateSlackMessage(context.Background(), api, j.Channel, j.Timestamp,
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionBlocks(blocks...),
+	)
+}
+
+// Find returns the job in progress with the provided ID
+func (store *jobStore) Find(id string) (*job, bool) {
+	if store == nil {
+		return nil, false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	j, ok := store.active[id]
+	return j, ok
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	SlackQueueReleaseAction  = "queue_release"
+	SlackCancelReleaseAction = "cancel_release"
+	SlackLeaveQueueAction    = "leave_release_queue"
+)
+
+// releaseSlot is a release holding, or waiting for, a place in a lock
+type releaseSlot struct {
+	ID     string
+	Key    string
+	Target string
+	User   string
+	Since  time.Time
+
+	// closed when the slot gets a place in the lock or leaves the queue
+	ready     chan struct{}
+	cancelled chan struct{}
+
+	// the message that shows the position in the queue, and whether the
+	// slot was dropped from the queue because ally is restarting
+	channel   string
+	timestamp string
+	dropped   bool
+}
+
+func newReleaseSlot(key, target, user string) *releaseSlot {
+	return &releaseSlot{
+		ID:        newRandomID(),
+		Key:       key,
+		Target:    target,
+		User:      user,
+		Since:     time.Now(),
+		ready:     make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// releaseLock limits the releases that run at the same time for a project,
+// or a group of projects, the ones that don't fit wait in a queue
+type releaseLock struct {
+	limit   int
+	holders []*releaseSlot
+	queue   []*releaseSlot
+}
+
+// releaseLocks keeps the locks of every project and concurrency group,
+// the queues live in memory and don't survive a restart, the users waiting
+// in them are told when ally shuts down
+var releaseLocks = struct {
+	sync.Mutex
+	locks map[string]*releaseLock
+	slots map[string]*releaseSlot
+}{locks: map[string]*releaseLock{}, slots: map[string]*releaseSlot{}}
+
+func lockFor(key string, limit int) *releaseLock {
+	lock, ok := releaseLocks.locks[key]
+	if !ok {
+		lock = &releaseLock{}
+		releaseLocks.locks[key] = lock
+	}
+	// the limit can change when the config is updated
+	lock.limit = limit
+	return lock
+}
+
+// acquireRelease gives the slot a place in the lock if there is room for
+// it, else it is queued, returns the position of the slot in the queue
+func acquireRelease(slot *releaseSlot, limit int) int {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	lock := lockFor(slot.Key, limit)
+	releaseLocks.slots[slot.ID] = slot
+
+	if len(lock.holders) < lock.limit && len(lock.queue) == 0 {
+		lock.holders = append(lock.holders, slot)
+		close(slot.ready)
+		return 0
+	}
+
+	lock.queue = append(lock.queue, slot)
+	return len(lock.queue)
+}
+
+// holdRelease gives the slot a place in the lock even if it is full,
+// used for releases that were already running before a restart
+func holdRelease(slot *releaseSlot, limit int) {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	lock := lockFor(slot.Key, limit)
+	releaseLocks.slots[slot.ID] = slot
+	lock.holders = append(lock.holders, slot)
+	close(slot.ready)
+}
+
+// freeRelease frees the place of the slot in the lock and lets the next
+// queued releases in
+func freeRelease(slot *releaseSlot) {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	lock, ok := releaseLocks.locks[slot.Key]
+	if !ok {
+		return
+	}
+	delete(releaseLocks.slots, slot.ID)
+	lock.holders = removeSlot(lock.holders, slot.ID)
+	lock.promote()
+
+	if len(lock.holders) == 0 && len(lock.queue) == 0 {
+		delete(releaseLocks.locks, slot.Key)
+	}
+}
+
+// leaveQueue removes the slot from its queue, returns false if the slot
+// is not queued anymore
+func leaveQueue(slot *releaseSlot) bool {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	lock, ok := releaseLocks.locks[slot.Key]
+	if !ok {
+		return false
+	}
+
+	queued := len(lock.queue)
+	lock.queue = removeSlot(lock.queue, slot.ID)
+	if len(lock.queue) == queued {
+		return false
+	}
+
+	delete(releaseLocks.slots, slot.ID)
+	close(slot.cancelled)
+	return true
+}
+
+// dropQueuedReleases empties every queue, the queued releases never start
+func dropQueuedReleases() []releaseSlot {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	out := []releaseSlot{}
+	for key, lock := range releaseLocks.locks {
+		for _, slot := range lock.queue {
+			slot.dropped = true
+			delete(releaseLocks.slots, slot.ID)
+			close(slot.cancelled)
+			out = append(out, *slot)
+		}
+		lock.queue = nil
+		if len(lock.holders) == 0 {
+			delete(releaseLocks.locks, key)
+		}
+	}
+	return out
+}
+
+// droppedReleaseText tells the user that the queued release won't start
+func droppedReleaseText(slot *releaseSlot) string {
+	return fmt.Sprintf(":recycle: I'm restarting, the queued release of *%s* was dropped. "+
+		"<@%s> please release it again when I'm back.", slot.Target, slot.User)
+}
+
+// promote lets the queued releases in while there is room for them
+func (lock *releaseLock) promote() {
+	for len(lock.holders) < lock.limit && len(lock.queue) != 0 {
+		next := lock.queue[0]
+		lock.queue = lock.queue[1:]
+		lock.holders = append(lock.holders, next)
+		close(next.ready)
+	}
+}
+
+func removeSlot(slots []*releaseSlot, id string) []*releaseSlot {
+	out := slots[:0]
+	for _, s := range slots {
+		if s.ID != id {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// releaseHolders returns the releases holding the lock if it is full
+func releaseHolders(key string, limit int) ([]releaseSlot, bool) {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	lock, ok := releaseLocks.locks[key]
+	if !ok {
+		return nil, false
+	}
+
+	out := []releaseSlot{}
+	for _, s := range lock.holders {
+		out = append(out, *s)
+	}
+	return out, len(lock.holders) >= limit || len(lock.queue) != 0
+}
+
+// waitForRelease blocks until the slot gets a place in the lock, while it
+// waits, a message in the channel shows its position in the queue and
+// a button to leave it, returns false if the slot left the queue
+func waitForRelease(ctx context.Context, api *slack.Client, channel string, slot *releaseSlot, position int) bool {
+	select {
+	case <-slot.ready:
+		return true
+	default:
+	}
+
+	logger.Infow("release queued", "target", slot.Target, "user", slot.User, "lock", slot.Key, "position", position)
+	timestamp := postSlackMessage(ctx, api, channel,
+		slack.MsgOptionBlocks(renderQueuedRelease(slot, position)...),
+	)
+
+	releaseLocks.Lock()
+	slot.channel, slot.timestamp = channel, timestamp
+	releaseLocks.Unlock()
+
+	select {
+	case <-slot.ready:
+		updateSlackMessage(ctx, api, channel, timestamp,
+			slack.MsgOptionText(fmt.Sprintf(":arrow_forward: It's the turn of *%s*, <@%s>! (waited %s)",
+				slot.Target, slot.User, time.Since(slot.Since).Round(time.Second)), false),
+		)
+		return true
+	case <-slot.cancelled:
+		releaseLocks.Lock()
+		text := fmt.Sprintf(":wastebasket: The release of *%s* left the queue.", slot.Target)
+		if slot.dropped {
+			text = droppedReleaseText(slot)
+		}
+		releaseLocks.Unlock()
+
+		updateSlackMessage(ctx, api, channel, timestamp, slack.MsgOptionText(text, false))
+		return false
+	}
+}
+
+func renderQueuedRelease(slot *releaseSlot, position int) []slack.Block {
+	text := fmt.Sprintf(":hourglass_flowing_sand: The release of *%s* is queued in position %d, "+
+		"I'll start it as soon as the ones in progress finish.", slot.Target, position)
+	return []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+		slack.NewActionBlock("",
+			slack.NewButtonBlockElement(SlackLeaveQueueAction, slot.ID,
+				slack.NewTextBlockObject(slack.PlainTextType, "Leave the queue", false, false),
+			),
+		),
+	}
+}
+
+// renderBusyProject returns the message shown when a project is selected
+// while the releases it shares a lock with are in progress
+func renderBusyProject(p *project, holders []releaseSlot) []slack.Block {
+	inFlight := []string{}
+	for _, h := range holders {
+		inFlight = append(inFlight, fmt.Sprintf("• *%s* started by <@%s> %s ago",
+			h.Target, h.User, time.Since(h.Since).Round(time.Second)))
+	}
+
+	text := fmt.Sprintf(":construction: I can't release *%s* right now, these releases are in progress:\n%s\n\n"+
+		"Do you want to queue it?", p.Repository, strings.Join(inFlight, "\n"))
+	return []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+		slack.NewActionBlock("",
+			slack.NewButtonBlockElement(SlackQueueReleaseAction, p.Repository,
+				slack.NewTextBlockObject(slack.PlainTextType, "Queue it", false, false),
+			).WithStyle(slack.StylePrimary),
+			slack.NewButtonBlockElement(SlackCancelReleaseAction, p.Repository,
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+			),
+		),
+	}
+}
+
+// queuedReleases returns the releases waiting in every queue, in the order
+// they'll get a place in their lock
+func queuedReleases() []releaseSlot {
+	releaseLocks.Lock()
+	defer releaseLocks.Unlock()
+
+	out := []releaseSlot{}
+	for _, lock := range releaseLocks.locks {
+		for _, slot := range lock.queue {
+			out = append(out, *slot)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+// handleLeaveQueueAction removes a queued release from its queue, only the
+// user that requested the release can do it
+func handleLeaveQueueAction(ctx context.Context, api *slack.Client, callback slack.InteractionCallback, id string) {
+	releaseLocks.Lock()
+	slot, ok := releaseLocks.slots[id]
+	releaseLocks.Unlock()
+
+	if !ok {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, callback.User.ID,
+			":warning: This release is no longer queued.")
+		return
+	}
+	if slot.User != callback.User.ID {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, callback.User.ID,
+			fmt.Sprintf(":no_entry: Only <@%s> can remove this release from the queue.", slot.User))
+		return
+	}
+
+	if !leaveQueue(slot) {
+		postEphemeralSlackMessage(ctx, api, callback.Channel.ID, callback.User.ID,
+			":warning: This release already started.")
+		return
+	}
+	logger.Infow("release left the queue", "target", slot.Target, "user", slot.User, "lock", slot.Key)
+}
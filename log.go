@@ -4,16 +4,22 @@ import (
 	"os"
 
 	"github.com/lacework/go-sdk/lwlogger"
+	"go.uber.org/zap"
 )
 
-var logger = lwlogger.New("INFO").Sugar()
+var logger = newLogger("INFO")
 
 func init() {
 	if debug() {
-		logger = lwlogger.New("DEBUG").Sugar()
+		logger = newLogger("DEBUG")
 	}
 }
 
+// newLogger returns a logger that masks secrets, see redact.go
+func newLogger(level string) *zap.SugaredLogger {
+	return lwlogger.New(level).WithOptions(zap.WrapCore(newRedactingCore)).Sugar()
+}
+
 func debug() bool {
 	return os.Getenv("DEBUG") != ""
 }
@@ -1,14 +1,50 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// serve runs the Slack app until ally is stopped
+func serve(path string) {
 	// load config file ally.toml
-	config, err := LoadConfig(*cFlag)
+	config, err := LoadConfig(path)
 	if err != nil {
 		logger.Fatalw("unable to load config", "error", err.Error())
 	}
 
 	// validate environment
 	validateEnvironment(config)
+	setConfig(config)
+	dryRun = config.DryRun
+	if dryRun {
+		logger.Warnw("dry-run mode, releases are simulated")
+	}
+
+	// open the audit log and verify that no one tampered with it
+	audit, err = openAuditLog(config.AuditLogPath(), config.AuditAnchorPath())
+	if audit == nil {
+		logger.Fatalw("unable to open audit log", "path", config.AuditLogPath(), "error", err.Error())
+	}
+	auditErr := err
+	if auditErr != nil {
+		logger.Errorw("audit log integrity check failed", "path", config.AuditLogPath(), "error", err.Error())
+	}
+
+	// open the store of jobs that survive restarts
+	jobs, err = openJobStore(config.JobsDir())
+	if err != nil {
+		logger.Fatalw("unable to open job store", "path", config.JobsDir(), "error", err.Error())
+	}
 
 	// connec to to Slack
 	client, api, err := connectToSlackViaSocketmode()
@@ -16,38 +52,74 @@ func main() {
 		logger.Fatalw("unable to connect to slack", "error", err.Error())
 	}
 
+	// executors that run the Slack events and the releases, the event
+	// loop only acknowledges events and hands them over
+	eventExecutor = newExecutor("events", eventExecutorWorkers, eventExecutorQueue, eventTimeout,
+		api, config.NotifySlackChannel)
+	jobExecutor = newExecutor("jobs", config.Executor.WorkerCount(), config.Executor.QueueSize(),
+		config.Executor.Timeout(), api, config.NotifySlackChannel)
+
+	// liveness, readiness and diagnostics for the orchestrator
+	startHealthServer(config)
+
 	// goroutine to listen to Slack events
-	go listenToSlackEvents(client, api, config)
+	go listenToSlackEvents(client, api)
+
+	// reload the config on SIGHUP or when the file changes
+	go watchConfig(context.Background(), api)
+
+	// keep the members of the user groups at hand for the access checks
+	go warmUserGroups(context.Background(), api)
+
+	// ECS sends SIGTERM on deploys, drain the releases in progress
+	// before closing the connection to Slack
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	go func() {
+		<-signals.Done()
+		shutdown(api, currentConfig())
+		disconnect()
+	}()
 
 	// notify slack channel about new deployment
-	notifySlackChannel(api, config.NotifySlackChannel, "I just got re-deployed! :blue-blob-dance:")
+	notifySlackChannel(ctx, api, config.NotifySlackChannel, "I just got re-deployed! :blue-blob-dance:")
+	if auditErr != nil {
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			":rotating_light: The audit log integrity check failed: "+auditErr.Error())
+	} else if seq, hash := audit.Head(); seq != 0 {
+		// the channel keeps a copy of the head of the chain that the
+		// data directory can't rewrite
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			fmt.Sprintf(":lock: Audit log verified up to entry %d (`%s`)", seq, hash))
+	}
 
-	if err := client.Run(); err != nil {
+	// reattach to the jobs that were in progress before the restart
+	resumeJobs(api, config)
+
+	if err := client.RunContext(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		logger.Fatalw("unable to run ally Slack app", "error", err.Error())
 	}
+	logger.Infow("disconnected from Slack, bye!")
 }
 
 func validateEnvironment(config *c) {
-	// verify if the codefresh CLI is installed
-	if !codefreshCLIExists() {
-		logger.Fatalw("missing dependency", "bin", "codefresh")
-	}
-
-	// verify if the Github CLI is installed
-	if !githubCLIExists() {
-		logger.Fatalw("missing dependency", "bin", "gh")
+	if err := config.verifyEnvironment(); err != nil {
+		logger.Fatalw("invalid environment", "error", err.Error())
 	}
+}
 
-	// verify that there is a codefresh config on disk
-	// if there is not one, try to configure it
-	if err := config.verifyCodefreshConfig(); err != nil {
-		logger.Fatalw("unable to configure the Codefresh CLI",
-			"error", err.Error(),
-		)
+// verifyEnvironment checks that the environment has what the config needs
+func (config *c) verifyEnvironment() error {
+	// verify that the Codefresh API is configured via environment variable,
+	// only needed when there are projects released via Codefresh pipelines
+	if config.UsesBackend(BackendCodefresh) {
+		if err := config.verifyCodefreshConfig(); err != nil {
+			return errors.Wrap(err, "Codefresh API not configured")
+		}
 	}
 
-	// verify that the Github CLI is configured via environment variable
-	if err := config.verifyGithubCLIConfig(); err != nil {
-		logger.Fatalw("Github CLI not configured", "error", err.Error())
-	}
+	// verify that the Github API is configured via environment variable
+	return errors.Wrap(config.verifyGithubConfig(), "Github API not configured")
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// metrics are exposed in the Prometheus text format, ally only needs
+// counters and histograms so we don't pull the whole client library
+
+// durationBuckets are the buckets, in seconds, of the histograms of releases
+// and approvals, from a few seconds up to a day
+var durationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400, 43200, 86400}
+
+var (
+	slackEventsTotal = newCounterVec("ally_slack_events_total",
+		"Slack events received by type.", "type")
+	slackAPIErrorsTotal = newCounterVec("ally_slack_api_errors_total",
+		"Failed calls to the Slack API by method.", "method")
+	slackRateLimitedTotal = newCounterVec("ally_slack_api_rate_limited_total",
+		"Calls to the Slack API that were rate limited by method.", "method")
+	socketmodeReconnectsTotal = newCounterVec("ally_socketmode_reconnects_total",
+		"Times ally reconnected to Slack via socketmode.")
+
+	releasesTriggeredTotal = newCounterVec("ally_releases_triggered_total",
+		"Releases and workflows triggered.", "kind", "target", "backend")
+	releasesFinishedTotal = newCounterVec("ally_releases_finished_total",
+		"Releases and workflows that finished by final state.", "kind", "target", "backend", "state")
+	releaseDurationSeconds = newHistogramVec("ally_release_duration_seconds",
+		"Time from triggering a release or workflow until it finished.", durationBuckets,
+		"kind", "target", "backend", "state")
+
+	backendRequestsTotal = newCounterVec("ally_backend_requests_total",
+		"Calls made to the release backends by operation and result.", "backend", "operation", "result")
+
+	approvalWaitSeconds = newHistogramVec("ally_approval_wait_seconds",
+		"Time from requesting an approval until it was approved, rejected or expired.", durationBuckets,
+		"kind", "target", "state")
+
+	metricsRegistry = []metric{
+		slackEventsTotal, slackAPIErrorsTotal, slackRateLimitedTotal, socketmodeReconnectsTotal,
+		releasesTriggeredTotal, releasesFinishedTotal, releaseDurationSeconds,
+		backendRequestsTotal, approvalWaitSeconds,
+	}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter partitioned by labels
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Inc adds one to the counter with the provided label values
+func (m *counterVec) Inc(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelKey(m.labels, values)]++
+}
+
+func (m *counterVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	if len(m.labels) == 0 && len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+	}
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatFloat(m.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+// Observe records a duration in the histogram with the provided label values
+func (m *histogramVec) Observe(d time.Duration, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := labelKey(m.labels, values)
+	h, ok := m.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.values[key] = h
+	}
+
+	seconds := d.Seconds()
+	for i, upper := range m.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *histogramVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	keys := []string{}
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := m.values[key]
+		for i, upper := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(key, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(key, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, key, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, key, h.count)
+	}
+}
+
+// labelKey renders the labels as they show up in the exposition format,
+// e.g. {type="app_mention"}, the rendered labels are also the key of the value
+func labelKey(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to a rendered set of labels
+func withLabel(key, name, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(key, "}") + "," + label + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+// recordSlackAPIError counts a failed call to the Slack API, rate limits
+// are counted separately since they usually mean we are too chatty
+func recordSlackAPIError(method string, err error) {
+	if err == nil {
+		return
+	}
+	slackAPIErrorsTotal.Inc(method)
+
+	var rateLimited *slack.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		slackRateLimitedTotal.Inc(method)
+	}
+}
+
+// recordBackendRequest counts a call made to a release backend
+func recordBackendRequest(backend, operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	backendRequestsTotal.Inc(backend, operation, result)
+}
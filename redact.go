@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redactedText = "[REDACTED]"
+
+// secrets shorter than this are not registered to avoid masking
+// common words or numbers all over the place
+const minSecretLength = 4
+
+var (
+	// redactor is the central place that knows about every secret that
+	// should never leave the process, it is used by the logger, the Slack
+	// client and anything else that writes data out
+	redactor = newSecretRedactor()
+
+	// well known token formats
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`xox[abposr]-[A-Za-z0-9-]+`),              // Slack tokens
+		regexp.MustCompile(`xapp-[A-Za-z0-9-]+`),                     // Slack app-level tokens
+		regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{20,}`),             // Github tokens
+		regexp.MustCompile(`github_pat_[A-Za-z0-9_]{20,}`),           // Github fine-grained tokens
+		regexp.MustCompile(`\b[0-9a-f]{24}\.[0-9a-f]{32}\b`),         // Codefresh API keys
+		regexp.MustCompile(`(?i)(authorization:\s*)(bearer\s+)?\S+`), // HTTP headers
+	}
+
+	// environment variables that hold secrets
+	secretEnvironmentVariables = []string{
+		"SLACK_BOT_TOKEN",
+		"SLACK_APP_TOKEN",
+		"GH_TOKEN",
+		"GH_ENTERPRISE_TOKEN",
+		"CODEFRESH_API_KEY",
+		auditKeyEnv,
+	}
+
+	// variables (KEY=VALUE) whose value is always a secret, more
+	// can be added with 'secret_variables' in the config file
+	defaultSecretVariables = []string{"mfa_token"}
+)
+
+type secretRedactor struct {
+	mu        sync.RWMutex
+	secrets   []secret
+	variables []string
+	varRegex  *regexp.Regexp
+}
+
+// secret is masked until it expires, if ever
+type secret struct {
+	value   string
+	expires time.Time
+}
+
+func (s secret) expired(now time.Time) bool {
+	return !s.expires.IsZero() && now.After(s.expires)
+}
+
+func newSecretRedactor() *secretRedactor {
+	r := &secretRedactor{}
+	for _, env := range secretEnvironmentVariables {
+		r.Register(os.Getenv(env))
+	}
+	r.RegisterVariableNames(defaultSecretVariables...)
+	return r
+}
+
+// Register adds secrets that need to be masked
+func (r *secretRedactor) Register(secrets ...string) {
+	r.register(time.Time{}, secrets)
+}
+
+// RegisterTemporary adds secrets that need to be masked for a while, like
+// one-time tokens that would otherwise be masked forever
+func (r *secretRedactor) RegisterTemporary(lifetime time.Duration, secrets ...string) {
+	r.register(time.Now().Add(lifetime), secrets)
+}
+
+func (r *secretRedactor) register(expires time.Time, secrets []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	kept := r.secrets[:0]
+	for _, s := range r.secrets {
+		if !s.expired(now) {
+			kept = append(kept, s)
+		}
+	}
+	r.secrets = kept
+
+	for _, s := range secrets {
+		if len(s) < minSecretLength {
+			continue
+		}
+		r.secrets = append(r.secrets, secret{value: s, expires: expires})
+	}
+
+	// longer secrets first, in case one secret contains another one
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i].value) > len(r.secrets[j].value)
+	})
+}
+
+// RegisterVariableNames adds names of variables whose values are secrets,
+// those are masked wherever they show up in the format KEY=VALUE
+func (r *secretRedactor) RegisterVariableNames(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addVariableNames(names)
+}
+
+// SetVariableNames replaces the names of the variables whose values are
+// secrets with the default ones and the provided ones, it is called every
+// time the config is loaded so that reloads don't pile them up
+func (r *secretRedactor) SetVariableNames(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.variables = nil
+	r.addVariableNames(defaultSecretVariables)
+	r.addVariableNames(names)
+}
+
+func (r *secretRedactor) addVariableNames(names []string) {
+	for _, name := range names {
+		// the names are matched regardless of their case
+		quoted := regexp.QuoteMeta(strings.ToLower(name))
+		if name != "" && !contains(r.variables, quoted) {
+			r.variables = append(r.variables, quoted)
+		}
+	}
+	r.varRegex = nil
+	if len(r.variables) != 0 {
+		r.varRegex = regexp.MustCompile(`(?i)\b(` + strings.Join(r.variables, "|") + `)=[^\s"&,]+`)
+	}
+}
+
+// IsSecretVariable returns true if the provided variable (KEY=VALUE) holds a secret
+func (r *secretRedactor) IsSecretVariable(variable string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.varRegex != nil && r.varRegex.MatchString(variable)
+}
+
+// Redact masks every known secret from the provided string
+func (r *secretRedactor) Redact(s string) string {
+	if s == "" {
+		return s
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	for _, secret := range r.secrets {
+		if !secret.expired(now) {
+			s = strings.ReplaceAll(s, secret.value, redactedText)
+		}
+	}
+	if r.varRegex != nil {
+		s = r.varRegex.ReplaceAllString(s, "$1="+redactedText)
+	}
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() == 0 {
+			s = pattern.ReplaceAllString(s, redactedText)
+		} else {
+			s = pattern.ReplaceAllString(s, "${1}"+redactedText)
+		}
+	}
+	return s
+}
+
+// RedactVariables returns a copy of the provided variables (KEY=VALUE) with
+// the secrets masked
+func (r *secretRedactor) RedactVariables(variables []string) []string {
+	out := make([]string, len(variables))
+	for i, v := range variables {
+		out[i] = r.Redact(v)
+	}
+	return out
+}
+
+// redactingCore is a zap core that masks secrets before writing log entries
+type redactingCore struct {
+	zapcore.Core
+}
+
+func newRedactingCore(core zapcore.Core) zapcore.Core {
+	return &redactingCore{core}
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = redactor.Redact(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		out[i] = redactField(f)
+	}
+	return out
+}
+
+func redactField(f zapcore.Field) zapcore.Field {
+	switch f.Type {
+	case zapcore.StringType:
+		return zap.String(f.Key, redactor.Redact(f.String))
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok && err != nil {
+			return zap.String(f.Key, redactor.Redact(err.Error()))
+		}
+		return f
+	case zapcore.BoolType, zapcore.DurationType, zapcore.TimeType, zapcore.TimeFullType,
+		zapcore.Float64Type, zapcore.Float32Type,
+		zapcore.Int64Type, zapcore.Int32Type, zapcore.Int16Type, zapcore.Int8Type,
+		zapcore.Uint64Type, zapcore.Uint32Type, zapcore.Uint16Type, zapcore.Uint8Type:
+		return f
+	}
+
+	// complex values are encoded to JSON and only replaced
+	// if they had something to redact
+	enc := zapcore.NewMapObjectEncoder()
+	f.AddTo(enc)
+	raw, err := json.Marshal(enc.Fields[f.Key])
+	if err != nil {
+		raw = []byte(fmt.Sprintf("%+v", enc.Fields[f.Key]))
+	}
+	if redacted := redactor.Redact(string(raw)); redacted != string(raw) {
+		return zap.String(f.Key, redacted)
+	}
+	return f
+}
+
+// redactingWriter masks secrets before writing to the underlying writer
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write([]byte(redactor.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactingHTTPClient masks secrets from the text of every request sent to
+// Slack, so that no message, update or view can leak them
+type redactingHTTPClient struct {
+	client *http.Client
+}
+
+func (rc *redactingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return rc.client.Do(req)
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	isForm := strings.HasPrefix(contentType, "application/x-www-form-urlencoded")
+	isJSON := strings.HasPrefix(contentType, "application/json")
+	if !isForm && !isJSON {
+		return rc.client.Do(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if isForm {
+		body = []byte(redactForm(string(body)))
+	} else {
+		body = []byte(redactJSONText(string(body)))
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return rc.client.Do(req)
+}
+
+// the fields of Slack API forms that users read, the others (channels,
+// timestamps, IDs, the token) are left alone so masking can't break a call
+var redactedFormFields = map[string]bool{
+	"text":        true,
+	"blocks":      true,
+	"attachments": true,
+	"view":        true,
+}
+
+// redactForm masks secrets in the fields of a form that users read
+func redactForm(body string) string {
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return body
+	}
+	for key, vs := range values {
+		if !redactedFormFields[key] {
+			continue
+		}
+		for i := range vs {
+			if key == "text" {
+				vs[i] = redactor.Redact(vs[i])
+			} else {
+				vs[i] = redactJSONText(vs[i])
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// redactJSONText masks secrets in the text of a JSON document, like the
+// text objects of blocks, the document is unchanged if there is no secret
+func redactJSONText(doc string) string {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return doc
+	}
+	if !redactTextValues(v) {
+		return doc
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return doc
+	}
+	return string(out)
+}
+
+// the keys of the texts in messages, blocks and attachments
+var textKeys = map[string]bool{"text": true, "fallback": true, "pretext": true, "title": true}
+
+// redactTextValues masks the texts in place and tells if any was masked
+func redactTextValues(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && textKeys[k] {
+				if redacted := redactor.Redact(s); redacted != s {
+					v[k] = redacted
+					changed = true
+				}
+				continue
+			}
+			changed = redactTextValues(child) || changed
+		}
+	case []interface{}:
+		for _, child := range v {
+			changed = redactTextValues(child) || changed
+		}
+	}
+	return changed
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// Modals to release a project, the form to pick the branch and fill the
+	// prompts of the project, then the confirmation of the picked values
+	SlackReleaseFormCallback    = "release_form"
+	SlackReleaseConfirmCallback = "release_confirm"
+
+	// Inputs of the release form for the branch and the commit
+	SlackReleaseRefBlock  = "release_ref"
+	SlackReleaseRefAction = "release_ref_value"
+	SlackReleaseShaBlock  = "release_sha"
+	SlackReleaseShaAction = "release_sha_value"
+)
+
+var (
+	// branch or tag names, a subset of what git allows that can't be
+	// mistaken for an option
+	gitRefPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+	gitShaPattern = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+)
+
+// releaseInput is what the user picked for a release, the variables
+// override the ones of the project
+type releaseInput struct {
+	Variables []string `json:"variables,omitempty"`
+	Ref       string   `json:"ref,omitempty"`
+	Sha       string   `json:"sha,omitempty"`
+}
+
+// releaseFormMetadata is stored in the release modals so that we know what
+// to release and where to report when they are submitted
+type releaseFormMetadata struct {
+	Project       string       `json:"project"`
+	Channel       string       `json:"channel"`
+	ResponseURL   string       `json:"response_url,omitempty"`
+	Input         releaseInput `json:"input"`
+	Justification string       `json:"justification,omitempty"`
+}
+
+// handleProjectSelection handles a project selected from the '/release' menu,
+// if other releases hold the lock of the project, the user is asked to queue
+// the release unless it was already asked to, then the release form is opened
+func handleProjectSelection(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback, repo string, queue bool) error {
+	if repo == "" {
+		return errors.New("callback event had no repository")
+	}
+
+	p, ok := config.FindProject(repo)
+	if !ok {
+		return errors.Errorf("project %s not found", repo)
+	}
+
+	if !p.Access.Allows(ctx, api, callback.User.ID, callback.Channel.ID) {
+		denyAccess(ctx, api, config, callback.User.ID, callback.Channel.ID,
+			fmt.Sprintf("release the *%s* project", p.Repository))
+		return nil
+	}
+
+	if !queue {
+		if holders, busy := releaseHolders(config.ConcurrencyFor(p)); busy {
+			postSlackMessage(ctx, api, callback.Channel.ID,
+				slack.MsgOptionBlocks(renderBusyProject(p, holders)...),
+				slack.MsgOptionReplaceOriginal(callback.ResponseURL),
+			)
+			return nil
+		}
+	}
+
+	return openReleaseForm(ctx, api, callback.TriggerID, p, releaseFormMetadata{
+		Project:     p.Repository,
+		Channel:     callback.Channel.ID,
+		ResponseURL: callback.ResponseURL,
+	})
+}
+
+// openReleaseForm opens a modal with the branch and the prompts of the project
+func openReleaseForm(ctx context.Context, api *slack.Client, triggerID string, p *project, metadata releaseFormMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.OpenViewContext(ctx, triggerID, renderReleaseForm(p, string(data)))
+	recordSlackAPIError("views.open", err)
+	return errors.Wrapf(err, "unable to open release form of project %s", p.Repository)
+}
+
+func renderReleaseForm(p *project, metadata string) slack.ModalViewRequest {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(
+			slack.NewTextBlockObject(slack.MarkdownType,
+				fmt.Sprintf("*%s*\n:gear: %s `%s`", p.Repository, p.BackendName(), p.Pipeline), false, false),
+			nil, nil,
+		),
+	}
+	if len(p.Variables) != 0 {
+		blocks = append(blocks, slack.NewContextBlock("",
+			slack.NewTextBlockObject(slack.MarkdownType,
+				"Variables: `"+strings.Join(redactor.RedactVariables(p.Variables), "` `")+"`", false, false),
+		))
+	}
+
+	label, hint := "Branch", "The default branch of the pipeline when empty"
+	if p.BackendName() == BackendGithub {
+		label, hint = "Branch or tag", "The default branch of the repository when empty"
+	}
+	ref := slack.NewPlainTextInputBlockElement(nil, SlackReleaseRefAction)
+	ref.InitialValue = p.Ref
+	refBlock := slack.NewInputBlock(SlackReleaseRefBlock,
+		slack.NewTextBlockObject(slack.PlainTextType, label, false, false),
+		slack.NewTextBlockObject(slack.PlainTextType, hint, false, false),
+		ref,
+	)
+	refBlock.Optional = true
+	blocks = append(blocks, refBlock)
+
+	// Github workflows can't run on a commit
+	if p.BackendName() == BackendCodefresh {
+		shaBlock := slack.NewInputBlock(SlackReleaseShaBlock,
+			slack.NewTextBlockObject(slack.PlainTextType, "Commit SHA", false, false),
+			slack.NewTextBlockObject(slack.PlainTextType, "The last commit of the branch when empty", false, false),
+			slack.NewPlainTextInputBlockElement(nil, SlackReleaseShaAction),
+		)
+		shaBlock.Optional = true
+		blocks = append(blocks, shaBlock)
+	}
+
+	prompts := p.ReleasePrompts()
+	for i := range prompts {
+		blocks = append(blocks, renderWorkflowInput(&prompts[i]))
+	}
+
+	if p.Approval != nil && p.Approval.Justification {
+		blocks = append(blocks, justificationInputBlock())
+	}
+
+	return slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      SlackReleaseFormCallback,
+		PrivateMetadata: metadata,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Release project", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Next", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks:          slack.Blocks{BlockSet: blocks},
+	}
+}
+
+// ReleasePrompts returns the prompts of the project, a prompt without a default
+// value defaults to the value of the variable it overrides
+func (p *project) ReleasePrompts() []workflowInput {
+	prompts := append([]workflowInput{}, p.Prompts...)
+	for i := range prompts {
+		if prompts[i].Default != "" {
+			continue
+		}
+		for _, v := range p.Variables {
+			if key, value, err := splitVariable(v); err == nil && key == prompts[i].Name {
+				prompts[i].Default = value
+			}
+		}
+	}
+	return prompts
+}
+
+// releaseFormFromCallback returns the metadata and the project of a submitted
+// release modal, false if the project is gone. It runs in the event loop, the
+// access to the project is checked when the release is confirmed
+func releaseFormFromCallback(config *c, callback slack.InteractionCallback) (releaseFormMetadata, *project, bool) {
+	var metadata releaseFormMetadata
+	if err := json.Unmarshal([]byte(callback.View.PrivateMetadata), &metadata); err != nil {
+		logger.Errorw("unable to parse release form metadata", "error", err)
+		return metadata, nil, false
+	}
+
+	p, ok := config.FindProject(metadata.Project)
+	if !ok {
+		logger.Errorw("project from release form not found", "project", metadata.Project)
+		return metadata, nil, false
+	}
+	return metadata, p, true
+}
+
+// handleReleaseFormSubmission validates the submitted release form, if the
+// values are valid the confirmation is shown on top of the form, otherwise
+// the returned response shows the errors in the form
+func handleReleaseFormSubmission(api *slack.Client, config *c, callback slack.InteractionCallback) *slack.ViewSubmissionResponse {
+	metadata, p, ok := releaseFormFromCallback(config, callback)
+	if !ok {
+		return nil
+	}
+
+	state := callback.View.State
+	variables, formErrors := parseInputs(p.Prompts, state)
+
+	var ref, sha string
+	if state != nil {
+		ref = strings.TrimSpace(state.Values[SlackReleaseRefBlock][SlackReleaseRefAction].Value)
+		sha = strings.TrimSpace(state.Values[SlackReleaseShaBlock][SlackReleaseShaAction].Value)
+	}
+	if err := checkGitRef(ref); err != nil {
+		formErrors[SlackReleaseRefBlock] = err.Error()
+	}
+	if err := checkGitSha(sha); err != nil {
+		formErrors[SlackReleaseShaBlock] = err.Error()
+	}
+
+	justification := justificationFromState(state)
+	if p.Approval != nil && p.Approval.Justification && justification == "" {
+		formErrors[SlackJustificationBlock] = "A justification is required"
+	}
+
+	if len(formErrors) != 0 {
+		return slack.NewErrorsViewSubmissionResponse(formErrors)
+	}
+
+	metadata.Input = releaseInput{Variables: variables, Ref: ref, Sha: sha}
+	metadata.Justification = justification
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		logger.Errorw("unable to store release form metadata", "error", err)
+		return nil
+	}
+
+	view := renderReleaseConfirmation(p, metadata, string(data))
+	res := slack.NewPushViewSubmissionResponse(&view)
+	tagDryRunViewResponse(res)
+	return res
+}
+
+// renderReleaseConfirmation shows what is going to be released, 'Back'
+// goes back to the form
+func renderReleaseConfirmation(p *project, metadata releaseFormMetadata, data string) slack.ModalViewRequest {
+	variables := mergeVariables(p.Variables, metadata.Input.Variables)
+	lines := []string{
+		fmt.Sprintf(":rocket: Do you want to release *%s*?", p.Repository),
+		fmt.Sprintf("*:gear: Pipeline:* `%s` (%s)", p.Pipeline, p.BackendName()),
+		"*:twisted_rightwards_arrows: From:* " + describeRevision(metadata.Input.Ref, metadata.Input.Sha),
+	}
+	if len(variables) != 0 {
+		lines = append(lines, "*:pencil2: Variables:* `"+strings.Join(redactor.RedactVariables(variables), "` `")+"`")
+	}
+
+	submit := "Release"
+	if p.Approval != nil {
+		submit = "Request approval"
+		lines = append(lines, fmt.Sprintf(":lock: Needs the approval of <!subteam^%s>", p.Approval.ApproverGroup))
+	}
+	if metadata.Justification != "" {
+		lines = append(lines, "*:memo: Justification:*\n> "+strings.ReplaceAll(metadata.Justification, "\n", "\n> "))
+	}
+
+	return slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      SlackReleaseConfirmCallback,
+		PrivateMetadata: data,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Confirm release", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, submit, false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Back", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewSectionBlock(
+				slack.NewTextBlockObject(slack.MarkdownType, strings.Join(lines, "\n"), false, false),
+				nil, nil,
+			),
+		}},
+	}
+}
+
+// handleReleaseConfirmSubmission closes the release modals and releases the
+// project, or requests approval to release it
+func handleReleaseConfirmSubmission(api *slack.Client, config *c, callback slack.InteractionCallback) *slack.ViewSubmissionResponse {
+	metadata, p, ok := releaseFormFromCallback(config, callback)
+	if !ok {
+		return nil
+	}
+
+	err := eventExecutor.Submit(&task{
+		Name:    "submission of the release form of " + p.Repository,
+		Channel: metadata.Channel,
+		Run: func(ctx context.Context) error {
+			if !p.Access.Allows(ctx, api, callback.User.ID, metadata.Channel) {
+				denyAccess(ctx, api, config, callback.User.ID, metadata.Channel,
+					fmt.Sprintf("release the *%s* project", p.Repository))
+				return nil
+			}
+			return requestOrReleaseProject(ctx, api, config, callback.User.ID, p, metadata)
+		},
+	})
+	if err != nil {
+		postEphemeralSlackMessage(context.Background(), api, metadata.Channel, callback.User.ID,
+			rejectedMessage(err, "release *"+p.Repository+"*"))
+	}
+	return slack.NewClearViewSubmissionResponse()
+}
+
+// requestOrReleaseProject releases the project once the undo grace period is
+// over, or requests approval to release it if the project has an approval policy
+func requestOrReleaseProject(ctx context.Context, api *slack.Client, config *c, user string, p *project, metadata releaseFormMetadata) error {
+	if p.Approval != nil {
+		postSlackMessage(ctx, api, metadata.Channel,
+			slack.MsgOptionText("Roger that! :rockon:", false),
+			slack.MsgOptionReplaceOriginal(metadata.ResponseURL),
+		)
+
+		target := approvalTarget{
+			Kind:      ApprovalTargetProject,
+			Name:      p.Repository,
+			Variables: metadata.Input.Variables,
+			Ref:       metadata.Input.Ref,
+			Sha:       metadata.Input.Sha,
+		}
+		req, err := config.newApprovalRequest(target, metadata.Channel, user)
+		if err != nil {
+			return err
+		}
+		req.Justification = metadata.Justification
+		requestApproval(ctx, api, config, req)
+		return nil
+	}
+
+	// give the user a chance to undo the release before triggering it
+	grace := config.UndoGracePeriod()
+	pending := newPendingRelease(user, p.Repository, metadata.Channel)
+	if grace > 0 {
+		postSlackMessage(ctx, api, metadata.Channel,
+			slack.MsgOptionBlocks(renderPendingRelease(pending, grace)...),
+			slack.MsgOptionReplaceOriginal(metadata.ResponseURL),
+		)
+	}
+
+	// the grace period doesn't hold a worker of the executor, once it
+	// is over the release goes to the job executor
+	pending.Start(grace, func() {
+		// the event that released the project is over by now
+		ctx := context.Background()
+		postSlackMessage(ctx, api, metadata.Channel,
+			slack.MsgOptionText("Roger that! :rockon:", false),
+			slack.MsgOptionReplaceOriginal(metadata.ResponseURL),
+		)
+
+		if err := startProjectRelease(ctx, api, config, metadata.Channel, user, nil, p, metadata.Input); err != nil {
+			logger.Errorw("unable to release project",
+				"project", p.Repository, "backend", p.BackendName(), "error", err)
+		}
+	})
+	return nil
+}
+
+// checkGitRef returns an error if the branch or tag can't be released
+func checkGitRef(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	if !gitRefPattern.MatchString(ref) || strings.Contains(ref, "..") || strings.Contains(ref, "//") ||
+		strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".") || strings.HasSuffix(ref, ".lock") {
+		return errors.New("This is not a valid branch or tag name")
+	}
+	return nil
+}
+
+// checkGitSha returns an error if the commit is not a (short) SHA
+func checkGitSha(sha string) error {
+	if sha != "" && !gitShaPattern.MatchString(sha) {
+		return errors.New("Must be a commit SHA, 7 to 40 hexadecimal characters")
+	}
+	return nil
+}
+
+// check validates the input given outside of the release form against
+// the project, the same way the form does
+func (input *releaseInput) check(p *project) error {
+	if err := checkGitRef(input.Ref); err != nil {
+		return errors.Wrapf(err, "invalid ref '%s'", input.Ref)
+	}
+	if err := checkGitSha(input.Sha); err != nil {
+		return errors.Wrapf(err, "invalid sha '%s'", input.Sha)
+	}
+	if input.Sha != "" && p.BackendName() == BackendGithub {
+		return errGithubShaNotSupported
+	}
+
+	values := map[string]string{}
+	for _, v := range mergeVariables(p.Variables, input.Variables) {
+		if key, value, err := splitVariable(v); err == nil {
+			values[key] = value
+		}
+	}
+	for _, prompt := range p.ReleasePrompts() {
+		if err := prompt.Validate(values[prompt.Name]); err != nil {
+			return errors.Wrapf(err, "invalid variable '%s'", prompt.Name)
+		}
+	}
+	return nil
+}
+
+// describeRevision tells what a release runs on
+func describeRevision(ref, sha string) string {
+	switch {
+	case ref != "" && sha != "":
+		return fmt.Sprintf("`%s` at `%s`", ref, sha)
+	case sha != "":
+		return fmt.Sprintf("`%s`", sha)
+	case ref != "":
+		return fmt.Sprintf("`%s`", ref)
+	default:
+		return "the default branch"
+	}
+}
+
+// startProjectRelease hands the release of a project over to the job executor
+// once there is room for it in the lock of the project, until then the
+// release waits in the queue of the lock
+func startProjectRelease(ctx context.Context, api *slack.Client, config *c, channel, user string, approvers []string,
+	p *project, input releaseInput) error {
+	key, limit := config.ConcurrencyFor(p)
+	slot := newReleaseSlot(key, p.Repository, user)
+
+	submit := func() error {
+		err := jobExecutor.Submit(&task{
+			Name:    "release of " + p.Repository,
+			Channel: channel,
+			Run: func(ctx context.Context) error {
+				defer freeRelease(slot)
+				return runProjectRelease(ctx, api, config, channel, user, approvers, p, input)
+			},
+		})
+		if err != nil {
+			freeRelease(slot)
+			postSlackMessage(ctx, api, channel,
+				slack.MsgOptionText(rejectedMessage(err, "release *"+p.Repository+"*"), false),
+			)
+		}
+		return err
+	}
+
+	position := acquireRelease(slot, limit)
+	if position == 0 {
+		return submit()
+	}
+
+	// the queued release only waits here, it runs in the executor
+	go func() {
+		if !waitForRelease(context.Background(), api, channel, slot, position) {
+			return
+		}
+		if err := submit(); err != nil {
+			logger.Errorw("unable to start queued release", "project", p.Repository, "error", err)
+		}
+	}()
+	return nil
+}
+
+// runProjectRelease triggers the release of a project with its backend and
+// reports the progress in the provided channel, the input overrides the
+// variables and the branch from the config
+func runProjectRelease(ctx context.Context, api *slack.Client, config *c, channel, user string,
+	approvers []string, p *project, input releaseInput) error {
+	backend, err := config.backendFor(p)
+	if err != nil {
+		return err
+	}
+
+	notifySlackChannel(ctx, api,
+		config.NotifySlackChannel,
+		fmt.Sprintf("A release has been triggered for the *%s* project. :megamix:", p.Repository),
+	)
+
+	timestamp := postSlackMessage(ctx, api, channel,
+		slack.MsgOptionText(":waiting: Triggering the release PR of the *"+p.Repository+"* project :rocket:", false),
+	)
+
+	req := p.TriggerRequest()
+	req.Variables = mergeVariables(req.Variables, input.Variables)
+	if input.Ref != "" {
+		req.Ref = input.Ref
+	}
+	req.Sha = input.Sha
+
+	logger.Infow("releasing project", "project", p.Repository, "user", user, "ref", req.Ref, "sha", req.Sha)
+	j := newJob(ApprovalTargetProject, p.Repository, user, approvers, backend.Name(), req,
+		releaseMessages{
+			Running: "Triggering the release PR of the *" + p.Repository + "* project",
+			Success: ":white_check_mark: Release pipeline finished! (project: *" + p.Repository + "*)\n\n" +
+				"_:eyes: Look at <#" + config.NotifySlackChannel + "> for the release PR._",
+			Failure: ":x: Something went wrong while triggering the release! (project: *" + p.Repository + "*)",
+		},
+	)
+	j.Channel = channel
+	j.Timestamp = timestamp
+	return runJob(ctx, api, backend, j)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// how often the config file is checked for changes
+const configWatchInterval = 15 * time.Second
+
+// activeConfig holds the config used by new commands, the releases in
+// progress keep the config they started with
+var activeConfig atomic.Value
+
+// reloads are serialized so that two of them never race to swap the config
+var reloadMu sync.Mutex
+
+// currentConfig returns the config used by new commands
+func currentConfig() *c {
+	config, _ := activeConfig.Load().(*c)
+	return config
+}
+
+func setConfig(config *c) {
+	activeConfig.Store(config)
+}
+
+// reloadConfig loads the config file again and swaps it in if it is valid,
+// the differences with the previous config are posted to the notify channel
+func reloadConfig(ctx context.Context, api *slack.Client, reason string) (string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := currentConfig()
+	logger.Infow("reloading config", "path", old.path, "reason", reason)
+
+	config, err := LoadConfig(old.path)
+	if err == nil {
+		err = config.verifyEnvironment()
+	}
+	if err != nil {
+		logger.Errorw("config reload failed, keeping the current config", "path", old.path, "error", err)
+		notifySlackChannel(ctx, api, old.NotifySlackChannel,
+			fmt.Sprintf(":x: I couldn't reload my config (%s), I'm keeping the current one:\n> %s", reason, err))
+		return "", errors.Wrap(err, "invalid config")
+	}
+
+	if config.hash == old.hash {
+		return "The config didn't change.", nil
+	}
+
+	setConfig(config)
+	go refreshUserGroups(context.Background(), api, config.UserGroups())
+	diff := diffConfigs(old, config)
+	logger.Infow("config reloaded", "path", config.path, "hash", config.hash, "reason", reason)
+	notifySlackChannel(ctx, api, config.NotifySlackChannel,
+		fmt.Sprintf(":arrows_counterclockwise: I reloaded my config (%s)\n%s", reason, diff))
+	return diff, nil
+}
+
+// watchConfig reloads the config on SIGHUP and when the config file changes
+func watchConfig(ctx context.Context, api *slack.Client) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	modTime := configModTime(currentConfig().path)
+	for {
+		var reason string
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reason = "SIGHUP"
+		case <-ticker.C:
+			t := configModTime(currentConfig().path)
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			reason = "file changed"
+		}
+
+		if _, err := reloadConfig(ctx, api, reason); err != nil {
+			logger.Warnw("unable to reload config", "reason", reason, "error", err)
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Warnw("unable to stat config", "path", path, "error", err)
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// handleReloadCommand reloads the config from Slack, only admins can do it
+func handleReloadCommand(ctx context.Context, api *slack.Client, config *c, user, channel string) map[string]interface{} {
+	if !config.IsAdmin(ctx, api, user, channel) {
+		logger.Warnw("unauthorized config reload attempt", "user", user, "channel", channel)
+		return ephemeralResponse(":no_entry: Only ally admins can reload the config.")
+	}
+
+	diff, err := reloadConfig(ctx, api, "requested by <@"+user+">")
+	if err != nil {
+		return ephemeralResponse(":x: The new config is not valid, I'm keeping the current one:\n> " + err.Error())
+	}
+	return ephemeralResponse(":white_check_mark: Config reloaded.\n" + diff)
+}
+
+// diffConfigs describes the projects and workflows that were added, removed
+// or changed, and the settings that only take effect after a restart
+func diffConfigs(old, config *c) string {
+	oldProjects := map[string]interface{}{}
+	for i := range old.Projects {
+		oldProjects[old.Projects[i].Repository] = old.Projects[i]
+	}
+	newProjects := map[string]interface{}{}
+	for i := range config.Projects {
+		newProjects[config.Projects[i].Repository] = config.Projects[i]
+	}
+
+	oldWorkflows := map[string]interface{}{}
+	for i := range old.Workflows {
+		oldWorkflows[old.Workflows[i].Name] = old.Workflows[i]
+	}
+	newWorkflows := map[string]interface{}{}
+	for i := range config.Workflows {
+		newWorkflows[config.Workflows[i].Name] = config.Workflows[i]
+	}
+
+	lines := append(diffNamed("project", oldProjects, newProjects),
+		diffNamed("workflow", oldWorkflows, newWorkflows)...)
+
+	// these are only read when ally starts
+	if old.DataDirectory() != config.DataDirectory() ||
+		old.ListenAddr() != config.ListenAddr() ||
+		!reflect.DeepEqual(old.Executor, config.Executor) ||
+		old.DrainTimeout() != config.DrainTimeout() ||
+		old.DryRun != config.DryRun {
+		lines = append(lines, ":warning: Changes to `data_dir`, `http_addr`, `executor`, "+
+			"`shutdown_timeout` and `dry_run` need a restart")
+	}
+
+	if len(lines) == 0 {
+		return "No changes to projects or workflows."
+	}
+	return strings.Join(lines, "\n")
+}
+
+func diffNamed(kind string, old, updated map[string]interface{}) []string {
+	names := map[string]bool{}
+	for name := range old {
+		names[name] = true
+	}
+	for name := range updated {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	lines := []string{}
+	for _, name := range sorted {
+		before, existed := old[name]
+		after, exists := updated[name]
+		switch {
+		case !existed:
+			lines = append(lines, fmt.Sprintf(":heavy_plus_sign: Added %s *%s*", kind, name))
+		case !exists:
+			lines = append(lines, fmt.Sprintf(":heavy_minus_sign: Removed %s *%s*", kind, name))
+		case !reflect.DeepEqual(before, after):
+			lines = append(lines, fmt.Sprintf(":pencil2: Changed %s *%s*", kind, name))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// how long ally waits for releases to finish before exiting, ECS kills
+// the container 30s after sending SIGTERM unless told otherwise
+const defaultShutdownTimeout = 25 * time.Second
+
+// restartingMessage is the answer to any command received while shutting down
+const restartingMessage = ":recycle: I'm restarting, try again in a minute."
+
+var shuttingDown int32
+
+// isShuttingDown returns true once ally received a signal to stop
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// shutdown stops accepting commands and waits for the releases in progress
+// to finish, the ones that don't finish in time are left on disk and
+// resumed by the next ally
+func shutdown(api *slack.Client, config *c) {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	timeout := config.DrainTimeout()
+	inProgress := jobs.Active()
+	logger.Infow("shutting down", "timeout", timeout, "jobs", len(inProgress))
+
+	// users hear about what is left behind even when draining times out
+	ctx := context.Background()
+
+	msg := "I'm restarting, I'll be back in a minute! :recycle:"
+	if len(inProgress) != 0 {
+		msg = fmt.Sprintf("%s\nWaiting up to %s for %d releases in progress.", msg, timeout, len(inProgress))
+	}
+	notifySlackChannel(ctx, api, config.NotifySlackChannel, msg)
+
+	drain, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	callOffPendingActions(ctx, api, config)
+
+	// queued releases would start while we drain, and the queues don't
+	// survive the restart
+	dropped := dropQueuedReleases()
+
+	// events first since they can start new releases
+	for _, e := range []*executor{eventExecutor, jobExecutor} {
+		if err := e.Drain(drain); err != nil {
+			logger.Warnw("shutdown deadline exceeded", "error", err)
+		}
+	}
+
+	// the events drained can still have started or queued releases
+	callOffPendingActions(ctx, api, config)
+	dropped = append(dropped, dropQueuedReleases()...)
+	for i := range dropped {
+		notifyDroppedRelease(ctx, api, &dropped[i])
+	}
+	if len(dropped) != 0 {
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			fmt.Sprintf(":recycle: %d queued releases were dropped because of the restart.", len(dropped)))
+	}
+
+	// tell users that the runs we are leaving behind are not forgotten
+	unfinished := jobs.Active()
+	for _, j := range unfinished {
+		s := j.Snapshot()
+		text := fmt.Sprintf(":recycle: I'm restarting, I'll keep following *%s* when I'm back.", s.Target)
+		if s.Run != nil && s.Run.URL != "" {
+			text = fmt.Sprintf("%s\n*Build:* <%s|%s>", text, s.Run.URL, s.Run.ID)
+		}
+		updateJobMessage(api, j, text, false)
+		jobs.Save(j)
+	}
+
+	if len(unfinished) != 0 {
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			fmt.Sprintf(":recycle: %d releases are still running, I'll pick them up after the restart.", len(unfinished)))
+	}
+
+	if healthServer != nil {
+		if err := healthServer.Shutdown(drain); err != nil {
+			logger.Warnw("unable to stop health server", "error", err)
+		}
+	}
+	logger.Infow("shutdown complete", "unfinished_jobs", len(unfinished), "dropped_releases", len(dropped))
+}
+
+// callOffPendingActions undoes the releases in their grace period and cancels
+// the approval requests, they live in memory and would either start while
+// ally shuts down or be lost with the restart
+func callOffPendingActions(ctx context.Context, api *slack.Client, config *c) {
+	for _, pending := range undoPendingReleases() {
+		logger.Infow("pending release undone", "target", pending.Target, "user", pending.User)
+		postSlackMessage(ctx, api, pending.Channel, slack.MsgOptionText(
+			fmt.Sprintf(":recycle: I'm restarting, the release of *%s* was not triggered. "+
+				"<@%s> please release it again when I'm back.", pending.Target, pending.User), false))
+	}
+
+	if cancelled := cancelPendingApprovals(ctx, api); cancelled != 0 {
+		notifySlackChannel(ctx, api, config.NotifySlackChannel,
+			fmt.Sprintf(":recycle: %d approval requests were cancelled because of the restart.", cancelled))
+	}
+}
+
+// notifyDroppedRelease tells the requester of a queued release that it was
+// dropped, in the message that showed its position if it was posted already
+func notifyDroppedRelease(ctx context.Context, api *slack.Client, slot *releaseSlot) {
+	logger.Infow("queued release dropped", "target", slot.Target, "user", slot.User)
+	if slot.timestamp != "" {
+		updateSlackMessage(ctx, api, slot.channel, slot.timestamp,
+			slack.MsgOptionText(droppedReleaseText(slot), false))
+		return
+	}
+	if slot.channel != "" {
+		postSlackMessage(ctx, api, slot.channel, slack.MsgOptionText(droppedReleaseText(slot), false))
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
@@ -17,9 +19,10 @@ const (
 	SlackTriggerTechAllyProject  = "trigger_tech_ally_project"
 	SlackSelectedTechAllyProject = "selected_tech_ally_project"
 
-	// Github action to sign the Lacework CLI
-	SlackSignLaceworkCLIGithubAction = "sign_cli_via_gh_action"
-	SlackMfaTokenForGithubAction     = "mfa_token_for_gh_action"
+	// Github workflow from the config that signs the Lacework CLI, and
+	// the input that receives the version to sign
+	SignLaceworkCLIWorkflow     = "sign-cli"
+	SignLaceworkCLIVersionInput = "branch_or_tag"
 
 	// The length of the message when signing the Lacework CLI
 	AppMentionMessageToSignCLILength = 4
@@ -35,33 +38,58 @@ func connectToSlackViaSocketmode() (*socketmode.Client, *slack.Client, error) {
 		return nil, nil, errors.New("SLACK_APP_TOKEN must have the prefix \"xapp-\".")
 	}
 
+	api, err := newSlackAPI(appToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := socketmode.New(
+		api,
+		socketmode.OptionDebug(debug()),
+		socketmode.OptionLog(log.New(redactingWriter{os.Stdout}, "socketmode: ", log.Lshortfile|log.LstdFlags)),
+	)
+	return client, api, nil
+}
+
+// newSlackAPI returns a client of the Slack Web API, the app token is only
+// needed to connect via socketmode
+func newSlackAPI(appToken string) (*slack.Client, error) {
 	botToken := os.Getenv("SLACK_BOT_TOKEN")
 	if botToken == "" {
-		return nil, nil, errors.New("SLACK_BOT_TOKEN must be set.")
+		return nil, errors.New("SLACK_BOT_TOKEN must be set.")
 	}
 
 	if !strings.HasPrefix(botToken, "xoxb-") {
-		return nil, nil, errors.New("SLACK_BOT_TOKEN must have the prefix \"xoxb-\".")
+		return nil, errors.New("SLACK_BOT_TOKEN must have the prefix \"xoxb-\".")
 	}
 
-	api := slack.New(
-		botToken,
+	var httpClient slack.Option = slack.OptionHTTPClient(&redactingHTTPClient{&http.Client{}})
+	if dryRun {
+		httpClient = slack.OptionHTTPClient(&dryRunHTTPClient{&redactingHTTPClient{&http.Client{}}})
+	}
+
+	opts := []slack.Option{
 		slack.OptionDebug(debug()),
-		slack.OptionAppLevelToken(appToken),
-		slack.OptionLog(log.New(os.Stdout, "api: ", log.Lshortfile|log.LstdFlags)),
-	)
+		httpClient,
+		slack.OptionLog(log.New(redactingWriter{os.Stdout}, "api: ", log.Lshortfile|log.LstdFlags)),
+	}
+	if appToken != "" {
+		opts = append(opts, slack.OptionAppLevelToken(appToken))
+	}
 
-	client := socketmode.New(
-		api,
-		socketmode.OptionDebug(debug()),
-		socketmode.OptionLog(log.New(os.Stdout, "socketmode: ", log.Lshortfile|log.LstdFlags)),
-	)
-	return client, api, nil
+	// every request and log line goes through the redactor so
+	// that no secret makes it to Slack or to the logs
+	return slack.New(botToken, opts...), nil
 }
 
-func listenToSlackEvents(client *socketmode.Client, api *slack.Client, config *c) {
+func listenToSlackEvents(client *socketmode.Client, api *slack.Client) {
+	connected := false
 	for evt := range client.Events {
+		// every event uses the config that was active when it arrived
+		config := currentConfig()
+
 		logger.Debugw("raw received", "type", evt.Type, "raw", evt)
+		slackEventsTotal.Inc(string(evt.Type))
 
 		switch evt.Type {
 
@@ -74,9 +102,20 @@ func listenToSlackEvents(client *socketmode.Client, api *slack.Client, config *c
 
 			client.Ack(*evt.Request)
 
-			err := handleEventMessage(api, config, apiEvent)
+			err := eventExecutor.Submit(&task{
+				Name: "EventsAPI event " + apiEvent.InnerEvent.Type,
+				Run: func(ctx context.Context) error {
+					if err := handleEventMessage(ctx, api, config, apiEvent); err != nil {
+						logger.Errorw("unable to handle EventsAPI event", "event", apiEvent, "error", err)
+					}
+					return nil
+				},
+			})
 			if err != nil {
-				logger.Errorw("unable to handle EventsAPI event", "event", evt, "error", err)
+				logger.Errorw("EventsAPI event dropped", "event", evt, "error", err)
+				if mention, ok := apiEvent.InnerEvent.Data.(*slackevents.AppMentionEvent); ok {
+					notifySlackChannel(context.Background(), api, mention.Channel, rejectedMessage(err, "help you"))
+				}
 			}
 
 		case socketmode.EventTypeSlashCommand:
@@ -90,12 +129,27 @@ func listenToSlackEvents(client *socketmode.Client, api *slack.Client, config *c
 				"type", evt.Type, "username", cmd.UserName,
 				"command", cmd.Command, "channel_name", cmd.ChannelName)
 
-			notifySlackChannel(api,
-				config.NotifySlackChannel,
-				fmt.Sprintf("User %s is preparing a release via `/release`", cmd.UserName),
-			)
+			if isShuttingDown() {
+				client.Ack(*evt.Request, ephemeralResponse(restartingMessage))
+				continue
+			}
 
-			client.Ack(*evt.Request, renderSlackCommandPayload(config))
+			// the response is sent to the response URL of the command
+			// once the command is handled
+			err := eventExecutor.Submit(&task{
+				Name:    "slash command " + cmd.Command,
+				Channel: cmd.ChannelID,
+				Run: func(ctx context.Context) error {
+					respondToCommand(ctx, api, cmd, handleReleaseCommand(ctx, api, config, cmd))
+					return nil
+				},
+			})
+			if err != nil {
+				logger.Errorw("slash command dropped", "command", cmd.Command, "error", err)
+				client.Ack(*evt.Request, ephemeralResponse(rejectedMessage(err, "handle your command")))
+				continue
+			}
+			client.Ack(*evt.Request)
 
 		case socketmode.EventTypeInteractive:
 			callback, ok := evt.Data.(slack.InteractionCallback)
@@ -108,14 +162,48 @@ func listenToSlackEvents(client *socketmode.Client, api *slack.Client, config *c
 				"type", evt.Type, "response_url", callback.ResponseURL,
 				"value", callback.Value, "channel_name", callback.Channel.Name)
 
+			// the response to a form submission tells Slack whether
+			// to close the form or to show errors in it, the rest of
+			// the submission is handled by the event executor
+			if callback.Type == slack.InteractionTypeViewSubmission {
+				client.Ack(*evt.Request, handleViewSubmission(api, config, callback))
+				continue
+			}
+
 			var payload interface{}
 			client.Ack(*evt.Request, payload)
 
-			err := handleInteractiveEvent(api, config, callback)
+			err := eventExecutor.Submit(&task{
+				Name:    "Interactive event " + string(callback.Type),
+				Channel: callback.Channel.ID,
+				Run: func(ctx context.Context) error {
+					if err := handleInteractiveEvent(ctx, api, config, callback); err != nil {
+						logger.Errorw("unable to handle Interactive event", "callback", callback, "error", err)
+					}
+					return nil
+				},
+			})
 			if err != nil {
-				logger.Errorw("unable to handle Interactive event", "event", evt, "error", err)
+				logger.Errorw("Interactive event dropped", "event", evt, "error", err)
+				postEphemeralSlackMessage(context.Background(), api, callback.Channel.ID, callback.User.ID,
+					rejectedMessage(err, "handle your click"))
 			}
 
+		case socketmode.EventTypeConnected:
+			if connected {
+				socketmodeReconnectsTotal.Inc()
+			}
+			connected = true
+			setSlackConnected(true)
+
+		case socketmode.EventTypeHello:
+			setSlackConnected(true)
+
+		case socketmode.EventTypeConnecting, socketmode.EventTypeConnectionError,
+			socketmode.EventTypeDisconnect, socketmode.EventTypeInvalidAuth:
+			logger.Infow("socketmode connection event", "type", evt.Type)
+			setSlackConnected(false)
+
 		default:
 			logger.Warnw("unexpected event type received", "type", evt.Type, "raw", evt)
 		}
@@ -124,7 +212,7 @@ func listenToSlackEvents(client *socketmode.Client, api *slack.Client, config *c
 }
 
 // handleEventMessage will take an event and handle it properly based on the type of event
-func handleEventMessage(api *slack.Client, config *c, event slackevents.EventsAPIEvent) error {
+func handleEventMessage(ctx context.Context, api *slack.Client, config *c, event slackevents.EventsAPIEvent) error {
 	switch event.Type {
 
 	case slackevents.CallbackEvent:
@@ -136,7 +224,7 @@ func handleEventMessage(api *slack.Client, config *c, event slackevents.EventsAP
 				"type", event.Type, "inner_type", innerEvent.Type,
 				"user", ev.User, "channel", ev.Channel, "text", ev.Text)
 
-			if err := handleAppMentionEvent(api, config, ev); err != nil {
+			if err := handleAppMentionEvent(ctx, api, config, ev); err != nil {
 				return err
 			}
 		}
@@ -164,8 +252,8 @@ func handleEventMessage(api *slack.Client, config *c, event slackevents.EventsAP
 //         WEBHOOK_URL: ${{SLACK_WEBHOOK_URL}}
 //         MESSAGE: "<@U0279A42HV0> hello"
 // ```
-func handleAppMentionEvent(api *slack.Client, config *c, event *slackevents.AppMentionEvent) error {
-	notifySlackChannel(api, config.NotifySlackChannel, formatAppMentionMsg(event.User, event.Channel, event.Text))
+func handleAppMentionEvent(ctx context.Context, api *slack.Client, config *c, event *slackevents.AppMentionEvent) error {
+	notifySlackChannel(ctx, api, config.NotifySlackChannel, formatAppMentionMsg(event.User, event.Channel, event.Text))
 
 	if strings.Contains(event.Text, "sign_cli") {
 		actionArgs := strings.Split(event.Text, " ")
@@ -173,7 +261,7 @@ func handleAppMentionEvent(api *slack.Client, config *c, event *slackevents.AppM
 			// Malformed message
 			msg := "I was expecting a message with the following format:\n\n" +
 				"> @release_ally sign_cli VERSION BUILD_LINK"
-			notifySlackChannel(api, event.Channel, msg)
+			notifySlackChannel(ctx, api, event.Channel, msg)
 			return nil
 		}
 
@@ -183,31 +271,39 @@ func handleAppMentionEvent(api *slack.Client, config *c, event *slackevents.AppM
 		tag := actionArgs[2]
 		pipeline := actionArgs[3]
 
-		postSlackMessage(api,
-			event.Channel,
-			slack.MsgOptionBlocks(renderPayloadToSignCLI(tag, pipeline)...),
-			slack.MsgOptionMetadata(
-				slack.SlackMetadata{
-					EventType:    "sign_cli_metadata",
-					EventPayload: map[string]interface{}{"tag": tag},
-				}),
+		wf, ok := config.FindWorkflow(SignLaceworkCLIWorkflow)
+		if !ok {
+			notifySlackChannel(ctx, api, event.Channel,
+				fmt.Sprintf(":x: There is no `%s` workflow in my config, I can't sign the Lacework CLI.",
+					SignLaceworkCLIWorkflow))
+			return nil
+		}
+
+		if !wf.Access.Allows(ctx, api, event.User, event.Channel) {
+			denyAccess(ctx, api, config, event.User, event.Channel, "sign the Lacework CLI")
+			return nil
+		}
+
+		return requestOrRunWorkflow(ctx, api, config, event.Channel, event.User, wf,
+			[]string{SignLaceworkCLIVersionInput + "=" + tag},
+			"", "*:codefresh: Triggered by pipeline:*\n"+pipeline,
 		)
-		return nil
 	}
 
 	if strings.Contains(event.Text, "trigger_action") {
 
-		// Trigger generic Github Action, validate message format
+		// Trigger a Github workflow from the config, validate message format
 		actionArgs := strings.Split(event.Text, ":")
-		if len(actionArgs) != 2 {
+		if len(actionArgs) != 2 || len(strings.Fields(actionArgs[1])) != 1 {
 			// Malformed message
 			msg := "I was expecting a message with the following format:\n\n" +
-				"> @release_ally trigger_action:WORKFLOW_ID --repo [HOST/]OWNER/REPO"
-			notifySlackChannel(api, event.Channel, msg)
+				"> @release_ally trigger_action:WORKFLOW_NAME"
+			notifySlackChannel(ctx, api, event.Channel, msg)
 			return nil
 		}
 
-		return runGithubAction(api, event.Channel, actionArgs[1])
+		handleTriggerActionMention(ctx, api, config, event.User, event.Channel, strings.TrimSpace(actionArgs[1]))
+		return nil
 	}
 
 	// Unknown message, print help
@@ -217,12 +313,12 @@ func handleAppMentionEvent(api *slack.Client, config *c, event *slackevents.AppM
 			"There are three things I can help you with:\n\n"+
 			"*1. To trigger releases from the following <https://lacework.atlassian.net/l/cp/J73uu2wh|list of projects>*\nType: `/release`\n\n"+
 			"*2. To sign the Lacework CLI artifacts*\nType: `@release_ally sign_cli VERSION BUILD_LINK`\n\n"+
-			"*3. To trigger Github Workflows*\nType: `@release_ally trigger_action:WORKFLOW_ID --repo [HOST/]OWNER/REPO`\n\n"+
+			"*3. To trigger Github Workflows*\nType: `@release_ally trigger_action:WORKFLOW_NAME`\n\n"+
 			"",
 		false, false)
 	// TODO maybe add an accesory to make it nicer
 	helpSection := slack.NewSectionBlock(helpText, nil, nil)
-	postSlackMessage(api,
+	postSlackMessage(ctx, api,
 		event.Channel,
 		slack.MsgOptionBlocks(helpSection))
 	return nil
@@ -240,8 +336,9 @@ func createOptionBlockObjects(options []string) []*slack.OptionBlockObject {
 }
 
 // Update message to Slack wrapper that log errors
-func updateSlackMessage(api *slack.Client, channel string, timestamp string, options ...slack.MsgOption) {
-	_, _, _, err := api.UpdateMessage(channel, timestamp, options...)
+func updateSlackMessage(ctx context.Context, api *slack.Client, channel string, timestamp string, options ...slack.MsgOption) {
+	_, _, _, err := api.UpdateMessageContext(ctx, channel, timestamp, options...)
+	recordSlackAPIError("chat.update", err)
 	if err != nil {
 		logger.Errorw("unable to update message to slack channel",
 			"channel", channel,
@@ -251,8 +348,9 @@ func updateSlackMessage(api *slack.Client, channel string, timestamp string, opt
 }
 
 // Post message to Slack wrapper that log errors
-func postSlackMessage(api *slack.Client, channel string, options ...slack.MsgOption) string {
-	_, timestamp, err := api.PostMessage(channel, options...)
+func postSlackMessage(ctx context.Context, api *slack.Client, channel string, options ...slack.MsgOption) string {
+	_, timestamp, err := api.PostMessageContext(ctx, channel, options...)
+	recordSlackAPIError("chat.postMessage", err)
 	if err != nil {
 		logger.Errorw("unable to post message to slack channel",
 			"channel", channel,
@@ -262,9 +360,24 @@ func postSlackMessage(api *slack.Client, channel string, options ...slack.MsgOpt
 	return timestamp
 }
 
+// Post ephemeral message to Slack wrapper that log errors, only the
+// provided user will see the message
+func postEphemeralSlackMessage(ctx context.Context, api *slack.Client, channel, user, msg string) {
+	_, err := api.PostEphemeralContext(ctx, channel, user, slack.MsgOptionText(msg, false))
+	recordSlackAPIError("chat.postEphemeral", err)
+	if err != nil {
+		logger.Errorw("unable to post ephemeral message to slack channel",
+			"channel", channel,
+			"user", user,
+			"error", err,
+		)
+	}
+}
+
 // Notify To Slack
-func notifySlackChannel(api *slack.Client, channel, msg string) {
-	_, _, err := api.PostMessage(channel, slack.MsgOptionText(msg, false))
+func notifySlackChannel(ctx context.Context, api *slack.Client, channel, msg string) {
+	_, _, err := api.PostMessageContext(ctx, channel, slack.MsgOptionText(msg, false))
+	recordSlackAPIError("chat.postMessage", err)
 	if err != nil {
 		logger.Errorw("unable to post message to slack channel",
 			"channel", channel,
@@ -273,9 +386,22 @@ func notifySlackChannel(api *slack.Client, channel, msg string) {
 	}
 }
 
-func renderSlackCommandPayload(config *c) map[string]interface{} {
+// renderSlackCommandPayload returns the menu with the projects that the
+// user is allowed to release from the channel
+func renderSlackCommandPayload(ctx context.Context, api *slack.Client, config *c, user, channel string) map[string]interface{} {
+	projects := config.AllowedProjects(ctx, api, user, channel)
+	if len(projects) == 0 {
+		logger.Warnw("unauthorized attempt", "user", user, "channel", channel, "action", "/release")
+		return ephemeralResponse(":no_entry: Sorry, you are not allowed to release any project from this channel.")
+	}
+
+	blocks := []slack.Block{}
+	if dryRun {
+		blocks = append(blocks, dryRunContextBlock())
+	}
+
 	return map[string]interface{}{
-		"blocks": []slack.Block{
+		"blocks": append(blocks,
 			slack.NewSectionBlock(
 				&slack.TextBlockObject{
 					Type: slack.MarkdownType,
@@ -290,20 +416,47 @@ func renderSlackCommandPayload(config *c) map[string]interface{} {
 							Text: "tech-ally projects",
 						},
 						SlackSelectedTechAllyProject,
-						createOptionBlockObjects(config.ListProjects())...,
+						createOptionBlockObjects(projects)...,
 					),
 				),
 				slack.SectionBlockOptionBlockID(SlackTriggerTechAllyProject),
 			),
-		}}
+		)}
 }
 
 // handleInteractiveEvent will take an Interactive Event and handle it properly
-func handleInteractiveEvent(api *slack.Client, config *c, callback slack.InteractionCallback) error {
+func handleInteractiveEvent(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback) error {
 
 	switch callback.Type {
 	case slack.InteractionTypeBlockActions:
 
+		// buttons that don't need the state of the message
+		for _, action := range callback.ActionCallback.BlockActions {
+			switch action.ActionID {
+			case SlackOpenWorkflowForm:
+				return openWorkflowForm(ctx, api, config, callback, action.Value)
+			case SlackApproveAction, SlackRejectAction:
+				return handleApprovalAction(ctx, api, config, callback, action)
+			case SlackQueueReleaseAction:
+				return handleProjectSelection(ctx, api, config, callback, action.Value, true)
+			case SlackCancelReleaseAction:
+				postSlackMessage(ctx, api, callback.Channel.ID,
+					slack.MsgOptionText("No worries, I won't release *"+action.Value+"*. :ok_hand:", false),
+					slack.MsgOptionReplaceOriginal(callback.ResponseURL),
+				)
+				return nil
+			case SlackLeaveQueueAction:
+				handleLeaveQueueAction(ctx, api, callback, action.Value)
+				return nil
+			case SlackCancelJobAction:
+				handleCancelJobAction(ctx, api, config, callback, action.Value)
+				return nil
+			case SlackUndoReleaseAction:
+				handleUndoReleaseAction(ctx, api, config, callback, action.Value)
+				return nil
+			}
+		}
+
 		if callback.BlockActionState == nil {
 			// we need the state of the action to know what to do
 			// with it, else, we drop the message
@@ -317,29 +470,11 @@ func handleInteractiveEvent(api *slack.Client, config *c, callback slack.Interac
 
 			case SlackTriggerTechAllyProject:
 				repo := action[SlackSelectedTechAllyProject].SelectedOption.Value
-				go func() {
-					if err := runCodefreshPipeline(api, config, callback, repo); err != nil {
-						logger.Errorw("unable to run Codefresh pipeline",
-							"error", err, "raw", callback)
-					}
-				}()
-
-			case SlackSignLaceworkCLIGithubAction:
-				mfaToken := action[SlackMfaTokenForGithubAction].Value
-				tag, ok := callback.Message.Metadata.EventPayload["tag"]
-				if !ok {
-					logger.Errorw("unable to sign the Lacework CLI since 'tag' field was missing",
-						"block_id", id, "raw", action)
-					continue
+				if err := handleProjectSelection(ctx, api, config, callback, repo, false); err != nil {
+					logger.Errorw("unable to release project",
+						"error", err, "raw", callback)
 				}
 
-				go func() {
-					if err := runGithubActionWithCallback(api, config, callback, mfaToken, tag.(string)); err != nil {
-						logger.Errorw("unable to run Github workflow",
-							"error", err, "raw", callback)
-					}
-				}()
-
 			default:
 				logger.Errorw("unknown or not yet implemented interactive block_id",
 					"block_id", id, "raw", action)
@@ -347,7 +482,7 @@ func handleInteractiveEvent(api *slack.Client, config *c, callback slack.Interac
 		}
 
 	default:
-		notifySlackChannel(api,
+		notifySlackChannel(ctx, api,
 			config.NotifySlackChannel,
 			fmt.Sprintf("Some weird type just showed up: *%s*", callback.Type),
 		)
@@ -356,6 +491,31 @@ func handleInteractiveEvent(api *slack.Client, config *c, callback slack.Interac
 	return nil
 }
 
+// handleViewSubmission handles the submission of a modal, the returned
+// response (if any) is sent back to Slack when acknowledging the event.
+// It runs in the event loop, the handlers only validate the form there
+// and submit the rest to the event executor
+func handleViewSubmission(api *slack.Client, config *c, callback slack.InteractionCallback) interface{} {
+	switch callback.View.CallbackID {
+	case SlackWorkflowFormCallback:
+		if res := handleWorkflowFormSubmission(api, config, callback); res != nil {
+			return res
+		}
+	case SlackReleaseFormCallback:
+		if res := handleReleaseFormSubmission(api, config, callback); res != nil {
+			return res
+		}
+	case SlackReleaseConfirmCallback:
+		if res := handleReleaseConfirmSubmission(api, config, callback); res != nil {
+			return res
+		}
+	default:
+		logger.Errorw("unknown or not yet implemented view callback_id",
+			"callback_id", callback.View.CallbackID)
+	}
+	return nil
+}
+
 func formatAppMentionMsg(user, channel, text string) (msg string) {
 	// Who
 	if len(user) == 0 {
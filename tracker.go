@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// how often we ask a backend for the status of a run
+	runPollInterval = 10 * time.Second
+
+	// how many times in a row we tolerate a backend failing
+	// to report the status of a run before giving up
+	runMaxStatusErrors = 5
+)
+
+// trackRun polls the status of the provided run until it is done, the
+// update function is called every time the status changes
+func trackRun(ctx context.Context, backend releaseBackend, run *backendRun, update func(*runStatus)) (*runStatus, error) {
+	var (
+		last   runStatus
+		errs   int
+		ticker = time.NewTicker(runPollInterval)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		status, err := backend.Status(ctx, run)
+		if err != nil {
+			errs++
+			logger.Warnw("unable to get run status",
+				"backend", run.Backend, "id", run.ID, "attempt", errs, "error", err)
+			if errs >= runMaxStatusErrors {
+				return nil, errors.Wrap(err, "unable to get run status")
+			}
+			continue
+		}
+		errs = 0
+
+		if status.State != last.State || status.Step != last.Step {
+			logger.Infow("run status changed",
+				"backend", run.Backend, "id", run.ID,
+				"state", status.State, "step", status.Step)
+			update(status)
+			last = *status
+		}
+
+		if status.Done() {
+			return status, nil
+		}
+	}
+}
+
+// renderRunStatus returns the Slack message that represents the status of a run
+func renderRunStatus(msgs releaseMessages, run *backendRun, status *runStatus, triggeredAt time.Time) string {
+	var msg string
+	switch status.State {
+	case RunStatePending:
+		msg = fmt.Sprintf(":hourglass_flowing_sand: %s, waiting for it to start", msgs.Running)
+	case RunStateRunning:
+		msg = fmt.Sprintf(":waiting: %s :rocket:", msgs.Running)
+		if status.Step != "" {
+			msg = fmt.Sprintf("%s\n\n*Running step:* %s", msg, status.Step)
+		}
+	case RunStateSuccess:
+		msg = msgs.Success
+	case RunStateCancelled:
+		msg = fmt.Sprintf(":no_entry_sign: Terminated! %s was stopped before it finished", msgs.Running)
+	default:
+		msg = msgs.Failure
+		if status.FailedStep != "" {
+			msg = fmt.Sprintf("%s\n\n*Failed step:* %s", msg, status.FailedStep)
+		}
+	}
+
+	if status.Done() {
+		msg = fmt.Sprintf("%s\n*Elapsed time:* %s", msg, status.Elapsed(triggeredAt))
+	}
+
+	url := status.URL
+	if url == "" {
+		url = run.URL
+	}
+	if url != "" {
+		msg = fmt.Sprintf("%s\n*Build:* <%s|%s>", msg, url, run.ID)
+	}
+	return msg
+}
+
+// Elapsed returns how long the run took, if the backend didn't tell us
+// when the run started or finished we fallback to the provided time
+// and the current time respectively
+func (s *runStatus) Elapsed(since time.Time) time.Duration {
+	start, end := s.Started, s.Finished
+	if start.IsZero() {
+		start = since
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(start).Round(time.Second)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// how long the online validation waits for Codefresh and Github
+const validateOnlineTimeout = 2 * time.Minute
+
+// configProblem is something wrong in the config, the line is zero when
+// the problem can't be tied to a line of the file. Warnings are reported
+// but don't make the config invalid
+type configProblem struct {
+	Line    int
+	Message string
+	Warning bool
+}
+
+// configProblems is the error returned when a config is not valid
+type configProblems struct {
+	path     string
+	problems []configProblem
+}
+
+func (e *configProblems) Error() string {
+	lines := []string{fmt.Sprintf("invalid config %s, %d problems found:", e.path, len(e.problems))}
+	for _, p := range e.problems {
+		lines = append(lines, "  "+p.format(e.path))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p configProblem) format(path string) string {
+	msg := p.Message
+	if p.Warning {
+		msg = "warning: " + msg
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", path, msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", path, p.Line, msg)
+}
+
+// splitWarnings separates the problems that make the config invalid from
+// the warnings
+func splitWarnings(problems []configProblem) (errs, warnings []configProblem) {
+	for _, p := range problems {
+		if p.Warning {
+			warnings = append(warnings, p)
+		} else {
+			errs = append(errs, p)
+		}
+	}
+	return errs, warnings
+}
+
+var (
+	tomlArrayTableLine = regexp.MustCompile(`^\s*\[\[\s*([^\[\]]+?)\s*\]\]`)
+	tomlTableLine      = regexp.MustCompile(`^\s*\[\s*([^\[\]]+?)\s*\]`)
+	tomlKeyLine        = regexp.MustCompile(`^\s*([A-Za-z0-9_.-]+|"[^"]*")\s*=`)
+	tomlIndex          = regexp.MustCompile(`\[\d+\]`)
+)
+
+// tomlLocator knows the line of every table and key of a TOML file, the
+// decoder doesn't keep positions so we scan the file ourselves, paths
+// look like 'workflow[0].input[1].name'
+type tomlLocator struct {
+	lines map[string]int
+	keys  []string
+}
+
+func newTomlLocator(data string) *tomlLocator {
+	loc := &tomlLocator{lines: map[string]int{}}
+	counts := map[string]int{}
+	section := ""
+
+	// depth of the brackets of multi-line arrays, their lines are values
+	depth := 0
+	for i, line := range strings.Split(data, "\n") {
+		n := i + 1
+		if depth > 0 {
+			depth += strings.Count(line, "[") - strings.Count(line, "]")
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if m := tomlArrayTableLine.FindStringSubmatch(line); m != nil {
+			section = indexedTablePath(m[1], counts, true)
+			loc.add(section, n)
+			continue
+		}
+		if m := tomlTableLine.FindStringSubmatch(line); m != nil {
+			section = indexedTablePath(m[1], counts, false)
+			loc.add(section, n)
+			continue
+		}
+		if m := tomlKeyLine.FindStringSubmatch(line); m != nil {
+			path := strings.Trim(m[1], `"`)
+			if section != "" {
+				path = section + "." + path
+			}
+			loc.add(path, n)
+
+			rest := line[len(m[0]):]
+			if depth = strings.Count(rest, "[") - strings.Count(rest, "]"); depth < 0 {
+				depth = 0
+			}
+		}
+	}
+	return loc
+}
+
+// indexedTablePath adds the index of the arrays of tables to the name of
+// a table, e.g. 'workflow.input' becomes 'workflow[0].input[1]'
+func indexedTablePath(name string, counts map[string]int, array bool) string {
+	parts := strings.Split(name, ".")
+	path := ""
+	for i, part := range parts {
+		if path != "" {
+			path += "."
+		}
+		path += strings.Trim(strings.TrimSpace(part), `"`)
+
+		if i == len(parts)-1 && array {
+			counts[path]++
+			return fmt.Sprintf("%s[%d]", path, counts[path]-1)
+		}
+		if count := counts[path]; count > 0 {
+			path = fmt.Sprintf("%s[%d]", path, count-1)
+		}
+	}
+	return path
+}
+
+func (loc *tomlLocator) add(path string, line int) {
+	if _, ok := loc.lines[path]; !ok {
+		loc.lines[path] = line
+		loc.keys = append(loc.keys, path)
+	}
+}
+
+// Line returns the line of the path, or of its closest parent if the path
+// is not in the file, like a required key that is missing
+func (loc *tomlLocator) Line(path string) int {
+	for path != "" {
+		if line, ok := loc.lines[path]; ok {
+			return line
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return 0
+}
+
+// LinesOf returns the lines of the path without indexes, e.g. 'project.variable'
+// is found in every project that has it
+func (loc *tomlLocator) LinesOf(plain string) []int {
+	lines := []int{}
+	for _, path := range loc.keys {
+		if tomlIndex.ReplaceAllString(path, "") == plain {
+			lines = append(lines, loc.lines[path])
+		}
+	}
+	return lines
+}
+
+// configChecker collects the problems of a config
+type configChecker struct {
+	loc      *tomlLocator
+	problems []configProblem
+}
+
+func (check *configChecker) add(path, format string, args ...interface{}) {
+	check.problems = append(check.problems, configProblem{
+		Line:    check.loc.Line(path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (check *configChecker) warn(path, format string, args ...interface{}) {
+	check.problems = append(check.problems, configProblem{
+		Line:    check.loc.Line(path),
+		Message: fmt.Sprintf(format, args...),
+		Warning: true,
+	})
+}
+
+// sorted returns the problems ordered by line
+func (check *configChecker) sorted() []configProblem {
+	sort.SliceStable(check.problems, func(i, j int) bool {
+		return check.problems[i].Line < check.problems[j].Line
+	})
+	return check.problems
+}
+
+// checkConfig returns every problem found in the decoded config
+func checkConfig(config *c, md toml.MetaData, data string) []configProblem {
+	check := &configChecker{loc: newTomlLocator(data)}
+
+	for _, key := range md.Undecoded() {
+		lines := check.loc.LinesOf(key.String())
+		if len(lines) == 0 {
+			lines = []int{0}
+		}
+		for _, line := range lines {
+			check.problems = append(check.problems, configProblem{
+				Line:    line,
+				Message: fmt.Sprintf("unknown key '%s'", key),
+			})
+		}
+	}
+
+	if config.NotifySlackChannel == "" {
+		check.add("notify_slack_channel", "'notify_slack_channel' is required")
+	}
+
+	for name, limit := range config.ConcurrencyGroups {
+		if limit < 1 {
+			check.add("concurrency_groups."+name, "concurrency group '%s' must allow at least one release", name)
+		}
+	}
+
+	repos := map[string]bool{}
+	for i, p := range config.Projects {
+		path := fmt.Sprintf("project[%d]", i)
+		switch {
+		case p.Repository == "":
+			check.add(path, "project without 'repository'")
+		case repos[p.Repository]:
+			check.add(path+".repository", "duplicate project '%s'", p.Repository)
+		case isReleaseSubcommand(p.Repository):
+			check.add(path+".repository", "project '%s' can't be released by name, "+
+				"'/release %s' runs a subcommand", p.Repository, strings.ToLower(p.Repository))
+		}
+		repos[p.Repository] = true
+
+		if strings.TrimSpace(p.Pipeline) == "" {
+			check.add(path+".pipeline", "project '%s' has an empty 'pipeline'", p.Repository)
+		}
+
+		switch p.Backend {
+		case "", BackendCodefresh:
+		case BackendGithub:
+			if p.GithubRepo == "" {
+				check.add(path, "project '%s' uses the github backend without 'github_repo'", p.Repository)
+			} else if _, _, err := splitGithubRepo(p.GithubRepo); err != nil {
+				check.add(path+".github_repo", "project '%s': %s", p.Repository, err)
+			}
+			if p.CorrelationInput == "" {
+				check.warn(path, "project '%s' has no 'correlation_input', its run is not "+
+					"followed when other runs of the workflow start at the same time", p.Repository)
+			}
+		default:
+			check.add(path+".backend", "project '%s' has an unknown backend '%s', expected '%s' or '%s'",
+				p.Repository, p.Backend, BackendCodefresh, BackendGithub)
+		}
+
+		for _, v := range p.Variables {
+			if _, _, err := splitVariable(v); err != nil {
+				check.add(path+".variables", "project '%s': %s", p.Repository, err)
+			}
+		}
+
+		if p.Concurrency < 0 {
+			check.add(path+".concurrency", "project '%s' has a negative concurrency", p.Repository)
+		}
+		if _, ok := config.ConcurrencyGroups[p.ConcurrencyGroup]; p.ConcurrencyGroup != "" && !ok {
+			check.add(path+".concurrency_group", "project '%s' uses the unknown concurrency group '%s'",
+				p.Repository, p.ConcurrencyGroup)
+		}
+		check.inputs(path+".prompt", "project", p.Repository, p.Prompts)
+		check.approval(path+".approval", p.Approval)
+	}
+
+	names := map[string]bool{}
+	for i, wf := range config.Workflows {
+		path := fmt.Sprintf("workflow[%d]", i)
+		switch {
+		case wf.Name == "":
+			check.add(path, "workflow without 'name'")
+		case names[wf.Name]:
+			check.add(path+".name", "duplicate workflow '%s'", wf.Name)
+		}
+		names[wf.Name] = true
+
+		if wf.Repo == "" {
+			check.add(path, "workflow '%s' without 'repo'", wf.Name)
+		} else if _, _, err := splitGithubRepo(wf.Repo); err != nil {
+			check.add(path+".repo", "workflow '%s': %s", wf.Name, err)
+		}
+		if strings.TrimSpace(wf.Workflow) == "" {
+			check.add(path+".workflow", "workflow '%s' has an empty 'workflow'", wf.Name)
+		}
+		if wf.CorrelationInput == "" {
+			check.warn(path, "workflow '%s' has no 'correlation_input', its run is not "+
+				"followed when other runs of the workflow start at the same time", wf.Name)
+		}
+
+		check.inputs(path+".input", "workflow", wf.Name, wf.Inputs)
+		check.approval(path+".approval", wf.Approval)
+	}
+
+	return check.sorted()
+}
+
+// inputs checks the inputs of a workflow or the prompts of a project
+func (check *configChecker) inputs(path, kind, owner string, inputs []workflowInput) {
+	names := map[string]bool{}
+	for k := range inputs {
+		input := &inputs[k]
+		inputPath := fmt.Sprintf("%s[%d]", path, k)
+		switch {
+		case input.Name == "":
+			check.add(inputPath, "input of %s '%s' without 'name'", kind, owner)
+		case names[input.Name]:
+			check.add(inputPath+".name", "duplicate input '%s' in %s '%s'", input.Name, kind, owner)
+		}
+		names[input.Name] = true
+
+		switch input.Type {
+		case "", WorkflowInputString, WorkflowInputBoolean, WorkflowInputNumber:
+		case WorkflowInputChoice:
+			if len(input.Choices) == 0 {
+				check.add(inputPath, "choice input '%s' of %s '%s' without 'choices'", input.Name, kind, owner)
+			}
+		default:
+			check.add(inputPath+".type", "input '%s' of %s '%s' has an unknown type '%s'",
+				input.Name, kind, owner, input.Type)
+		}
+
+		if input.Default != "" {
+			if err := input.Validate(input.Default); err != nil {
+				check.add(inputPath+".default", "default of input '%s' of %s '%s' is not valid: %s",
+					input.Name, kind, owner, err)
+			}
+		}
+	}
+}
+
+func (check *configChecker) approval(path string, policy *approvalPolicy) {
+	if policy == nil {
+		return
+	}
+	if policy.ApproverGroup == "" {
+		check.add(path, "'approver_group' is required, without it nobody can approve")
+	}
+	if policy.Approvals < 0 {
+		check.add(path+".approvals", "'approvals' can't be negative")
+	}
+	if policy.Expiry.Duration < 0 {
+		check.add(path+".expiry", "'expiry' can't be negative")
+	}
+}
+
+// checkConfigOnline confirms that the Codefresh pipelines and Github
+// workflows of the config exist
+func checkConfigOnline(ctx context.Context, config *c, data string) []configProblem {
+	check := &configChecker{loc: newTomlLocator(data)}
+	github := newGithubBackend()
+
+	var codefresh *codefreshClient
+	if config.UsesBackend(BackendCodefresh) {
+		codefresh = newCodefreshClientFromEnv()
+	}
+
+	githubWorkflowExists := func(repository, workflow string) error {
+		client, repo, err := github.clientFor(repository)
+		if err != nil {
+			return err
+		}
+		return client.GetWorkflow(ctx, repo, workflow)
+	}
+
+	for i, p := range config.Projects {
+		path := fmt.Sprintf("project[%d].pipeline", i)
+		if p.Pipeline == "" {
+			continue
+		}
+
+		var err error
+		switch p.BackendName() {
+		case BackendCodefresh:
+			err = codefresh.GetPipeline(ctx, p.Pipeline)
+		case BackendGithub:
+			if p.GithubRepo != "" {
+				err = githubWorkflowExists(p.GithubRepo, p.Pipeline)
+			}
+		}
+		if err != nil {
+			check.add(path, "project '%s': %s", p.Repository, err)
+		}
+	}
+
+	for i, wf := range config.Workflows {
+		if wf.Repo == "" || wf.Workflow == "" {
+			continue
+		}
+		if err := githubWorkflowExists(wf.Repo, wf.Workflow); err != nil {
+			check.add(fmt.Sprintf("workflow[%d].workflow", i), "workflow '%s': %s", wf.Name, err)
+		}
+	}
+	return check.sorted()
+}
+
+// decodeConfig decodes the content of a config file and checks it, a
+// config with problems is returned together with them
+func decodeConfig(path, data string) (*c, []configProblem, error) {
+	var config c
+	md, err := toml.Decode(data, &config)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			// drop the 'toml: line N' prefix, the line is already in the problem
+			msg := parseErr.Error()
+			if i := strings.Index(msg, ": "); i >= 0 {
+				msg = msg[i+2:]
+			}
+			return nil, []configProblem{{Line: parseErr.Position.Line, Message: "invalid TOML: " + msg}}, nil
+		}
+		return nil, nil, errors.Wrapf(err, "unable to decode config %s", path)
+	}
+
+	// flags and environment variables win over the file
+	overrides.apply(&config)
+	return &config, checkConfig(&config, md, data), nil
+}
+
+// runValidateCommand checks a config file and prints its problems, it
+// returns the exit code of the command
+func runValidateCommand(args []string) int {
+	flags := newFlagSet("validate", "[flags]",
+		"Checks the config file and reports its problems with their line.")
+	cf := addConfigFlags(flags, false)
+	online := flags.Bool("online", false, "confirm that the Codefresh pipelines and Github workflows exist")
+	if extra := parseFlags(flags, args); len(extra) != 0 {
+		flags.Usage()
+		return 2
+	}
+	path := cf.resolve()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read config %s: %s\n", path, err)
+		return 1
+	}
+
+	config, problems, err := decodeConfig(path, string(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *online && config != nil {
+		if err := config.verifyEnvironment(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to validate online: %s\n", err)
+			return 1
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), validateOnlineTimeout)
+		defer cancel()
+		problems = append(problems, checkConfigOnline(ctx, config, string(data))...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p.format(path))
+	}
+	errs, warnings := splitWarnings(problems)
+	if len(errs) != 0 {
+		fmt.Printf("%d problems found\n", len(errs))
+		return 1
+	}
+	if len(warnings) != 0 {
+		fmt.Printf("%s is valid, %d warnings\n", path, len(warnings))
+		return 0
+	}
+
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
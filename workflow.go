@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// Types of the inputs of a workflow
+	WorkflowInputString  = "string"
+	WorkflowInputChoice  = "choice"
+	WorkflowInputBoolean = "boolean"
+	WorkflowInputNumber  = "number"
+
+	// Button that opens the form of a workflow
+	SlackOpenWorkflowForm = "open_workflow_form"
+
+	// Callback ID of the modal to run a workflow
+	SlackWorkflowFormCallback = "workflow_form"
+
+	// Action ID of every input of the workflow form, the block ID
+	// is the name of the input with this prefix
+	SlackWorkflowInputAction = "workflow_input"
+	SlackWorkflowInputPrefix = "input_"
+)
+
+// workflowFormMetadata is stored in the modal so that we know what
+// to run and where to report when the form is submitted
+type workflowFormMetadata struct {
+	Workflow string `json:"workflow"`
+	Channel  string `json:"channel"`
+}
+
+// handleTriggerActionMention replies to a 'trigger_action:NAME' message with
+// a button to open the form of the workflow, only the workflows declared in
+// the config file can be dispatched
+func handleTriggerActionMention(ctx context.Context, api *slack.Client, config *c, user, channel, name string) {
+	wf, ok := config.FindWorkflow(name)
+	if ok && !wf.Access.Allows(ctx, api, user, channel) {
+		denyAccess(ctx, api, config, user, channel, fmt.Sprintf("run the Github workflow *%s*", wf.Name))
+		return
+	}
+	if !ok {
+		msg := fmt.Sprintf("I don't know any workflow named '%s'.", name)
+		if names := config.ListWorkflows(); len(names) != 0 {
+			msg += " These are the ones I can run:\n\n> " + strings.Join(names, ", ")
+		}
+		notifySlackChannel(ctx, api, channel, msg)
+		return
+	}
+
+	text := slack.NewTextBlockObject(slack.MarkdownType,
+		fmt.Sprintf("*:gear: Github workflow:* %s\n*Repository:* %s\n*Workflow:* %s",
+			wf.Name, wf.Repo, wf.Workflow),
+		false, false)
+	btn := slack.NewButtonBlockElement(SlackOpenWorkflowForm, wf.Name,
+		slack.NewTextBlockObject(slack.PlainTextType, "Open form", false, false),
+	)
+	postSlackMessage(ctx, api, channel,
+		slack.MsgOptionBlocks(
+			slack.NewSectionBlock(text, nil, slack.NewAccessory(btn)),
+		),
+	)
+}
+
+// openWorkflowForm opens a modal with the inputs of the workflow
+func openWorkflowForm(ctx context.Context, api *slack.Client, config *c, callback slack.InteractionCallback, name string) error {
+	wf, ok := config.FindWorkflow(name)
+	if !ok {
+		return errors.Errorf("workflow %s not found", name)
+	}
+
+	if !wf.Access.Allows(ctx, api, callback.User.ID, callback.Channel.ID) {
+		denyAccess(ctx, api, config, callback.User.ID, callback.Channel.ID,
+			fmt.Sprintf("run the Github workflow *%s*", wf.Name))
+		return nil
+	}
+
+	metadata, err := json.Marshal(workflowFormMetadata{Workflow: wf.Name, Channel: callback.Channel.ID})
+	if err != nil {
+		return err
+	}
+
+	_, err = api.OpenViewContext(ctx, callback.TriggerID, renderWorkflowForm(wf, string(metadata)))
+	recordSlackAPIError("views.open", err)
+	return errors.Wrapf(err, "unable to open form of workflow %s", name)
+}
+
+func renderWorkflowForm(wf *workflow, metadata string) slack.ModalViewRequest {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(
+			slack.NewTextBlockObject(slack.MarkdownType,
+				fmt.Sprintf("*%s*\n%s/%s", wf.Name, wf.Repo, wf.Workflow), false, false),
+			nil, nil,
+		),
+	}
+	if wf.Description != "" {
+		blocks = append(blocks, slack.NewContextBlock("",
+			slack.NewTextBlockObject(slack.MarkdownType, wf.Description, false, false),
+		))
+	}
+
+	for i := range wf.Inputs {
+		blocks = append(blocks, renderWorkflowInput(&wf.Inputs[i]))
+	}
+
+	if wf.Approval != nil && wf.Approval.Justification {
+		blocks = append(blocks, justificationInputBlock())
+	}
+
+	return slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      SlackWorkflowFormCallback,
+		PrivateMetadata: metadata,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Run workflow", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Run", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks:          slack.Blocks{BlockSet: blocks},
+	}
+}
+
+func renderWorkflowInput(input *workflowInput) *slack.InputBlock {
+	var element slack.BlockElement
+	switch input.Type {
+	case WorkflowInputChoice:
+		sel := slack.NewOptionsSelectBlockElement(slack.OptTypeStatic, nil,
+			SlackWorkflowInputAction, createOptionBlockObjects(input.Choices)...)
+		for _, opt := range sel.Options {
+			if opt.Value == input.Default {
+				sel.InitialOption = opt
+			}
+		}
+		element = sel
+
+	case WorkflowInputBoolean:
+		opt := slack.NewOptionBlockObject("true",
+			slack.NewTextBlockObject(slack.PlainTextType, "Yes", false, false), nil)
+		checkbox := slack.NewCheckboxGroupsBlockElement(SlackWorkflowInputAction, opt)
+		if input.Default == "true" {
+			checkbox.InitialOptions = []*slack.OptionBlockObject{opt}
+		}
+		element = checkbox
+
+	default:
+		txt := slack.NewPlainTextInputBlockElement(nil, SlackWorkflowInputAction)
+		txt.InitialValue = input.Default
+		element = txt
+	}
+
+	var hint *slack.TextBlockObject
+	if input.Description != "" {
+		hint = slack.NewTextBlockObject(slack.PlainTextType, input.Description, false, false)
+	}
+
+	block := slack.NewInputBlock(
+		SlackWorkflowInputPrefix+input.Name,
+		slack.NewTextBlockObject(slack.PlainTextType, input.DisplayName(), false, false),
+		hint,
+		element,
+	)
+	// checkboxes can't be required, an unchecked box means false
+	block.Optional = !input.Required || input.Type == WorkflowInputBoolean
+	return block
+}
+
+// handleWorkflowFormSubmission validates the submitted form, if the inputs are
+// valid the workflow is dispatched by the event executor, otherwise the
+// returned response shows the errors in the form
+func handleWorkflowFormSubmission(api *slack.Client, config *c, callback slack.InteractionCallback) *slack.ViewSubmissionResponse {
+	var metadata workflowFormMetadata
+	if err := json.Unmarshal([]byte(callback.View.PrivateMetadata), &metadata); err != nil {
+		logger.Errorw("unable to parse workflow form metadata", "error", err)
+		return nil
+	}
+
+	wf, ok := config.FindWorkflow(metadata.Workflow)
+	if !ok {
+		logger.Errorw("workflow from form not found", "workflow", metadata.Workflow)
+		return nil
+	}
+
+	variables, formErrors := parseInputs(wf.Inputs, callback.View.State)
+	if len(formErrors) != 0 {
+		return slack.NewErrorsViewSubmissionResponse(formErrors)
+	}
+
+	justification := justificationFromState(callback.View.State)
+	if wf.Approval != nil && wf.Approval.Justification && justification == "" {
+		return slack.NewErrorsViewSubmissionResponse(map[string]string{
+			SlackJustificationBlock: "A justification is required",
+		})
+	}
+
+	// the form is closed right away, the workflow starts after the ack
+	err := eventExecutor.Submit(&task{
+		Name:    "submission of the " + wf.Name + " workflow form",
+		Channel: metadata.Channel,
+		Run: func(ctx context.Context) error {
+			if !wf.Access.Allows(ctx, api, callback.User.ID, metadata.Channel) {
+				denyAccess(ctx, api, config, callback.User.ID, metadata.Channel,
+					fmt.Sprintf("run the Github workflow *%s*", wf.Name))
+				return nil
+			}
+			return requestOrRunWorkflow(ctx, api, config, metadata.Channel, callback.User.ID, wf,
+				variables, justification, "")
+		},
+	})
+	if err != nil {
+		postEphemeralSlackMessage(context.Background(), api, metadata.Channel, callback.User.ID, rejectedMessage(err, "run *"+wf.Name+"*"))
+	}
+	return nil
+}
+
+// requestOrRunWorkflow runs the workflow, or requests approval to run
+// it if the workflow has an approval policy
+func requestOrRunWorkflow(ctx context.Context, api *slack.Client, config *c, channel, user string,
+	wf *workflow, variables []string, justification, details string) error {
+
+	if wf.Approval == nil {
+		return startWorkflow(ctx, api, config, channel, user, nil, wf, variables)
+	}
+
+	target := approvalTarget{Kind: ApprovalTargetWorkflow, Name: wf.Name, Variables: variables}
+	req, err := config.newApprovalRequest(target, channel, user)
+	if err != nil {
+		return err
+	}
+	req.Justification = justification
+	if details != "" {
+		req.Details += "\n" + details
+	}
+
+	requestApproval(ctx, api, config, req)
+	return nil
+}
+
+// parseInputs returns the inputs (KEY=VALUE) from the state of a form rendered
+// with renderWorkflowInput, or the errors to show per block if the values are
+// not valid
+func parseInputs(inputs []workflowInput, state *slack.ViewState) ([]string, map[string]string) {
+	var (
+		variables  []string
+		formErrors = map[string]string{}
+	)
+
+	for _, input := range inputs {
+		blockID := SlackWorkflowInputPrefix + input.Name
+
+		var action slack.BlockAction
+		if state != nil {
+			action = state.Values[blockID][SlackWorkflowInputAction]
+		}
+
+		var value string
+		switch input.Type {
+		case WorkflowInputChoice:
+			value = action.SelectedOption.Value
+		case WorkflowInputBoolean:
+			value = strconv.FormatBool(len(action.SelectedOptions) != 0)
+		default:
+			value = strings.TrimSpace(action.Value)
+		}
+
+		if err := input.Validate(value); err != nil {
+			formErrors[blockID] = err.Error()
+			continue
+		}
+		if value != "" {
+			variables = append(variables, input.Name+"="+value)
+		}
+	}
+
+	return variables, formErrors
+}
+
+// Validate checks that the value is valid for the input
+func (input *workflowInput) Validate(value string) error {
+	if value == "" {
+		if input.Required && input.Type != WorkflowInputBoolean {
+			return errors.New("This input is required")
+		}
+		return nil
+	}
+
+	switch input.Type {
+	case WorkflowInputNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return errors.New("This input must be a number")
+		}
+	case WorkflowInputChoice:
+		for _, choice := range input.Choices {
+			if choice == value {
+				return nil
+			}
+		}
+		return errors.Errorf("Must be one of: %s", strings.Join(input.Choices, ", "))
+	}
+	return nil
+}
+
+// startWorkflow hands the workflow over to the job executor
+func startWorkflow(ctx context.Context, api *slack.Client, config *c, channel, user string, approvers []string,
+	wf *workflow, variables []string) error {
+	err := jobExecutor.Submit(&task{
+		Name:    "workflow " + wf.Name,
+		Channel: channel,
+		Run: func(ctx context.Context) error {
+			return runWorkflow(ctx, api, config, channel, user, approvers, wf, variables)
+		},
+	})
+	if err != nil {
+		postSlackMessage(ctx, api, channel, slack.MsgOptionText(rejectedMessage(err, "run *"+wf.Name+"*"), false))
+	}
+	return err
+}
+
+// runWorkflow dispatches the workflow and reports its progress in the provided channel
+func runWorkflow(ctx context.Context, api *slack.Client, config *c, channel, user string,
+	approvers []string, wf *workflow, variables []string) error {
+	notifySlackChannel(ctx, api,
+		config.NotifySlackChannel,
+		fmt.Sprintf("User <@%s> triggered the Github workflow *%s* :gear:", user, wf.Name),
+	)
+
+	timestamp := postSlackMessage(ctx, api, channel,
+		slack.MsgOptionText(
+			fmt.Sprintf(":waiting: Running Github workflow *%s* for <@%s> :rocket:", wf.Name, user),
+			false,
+		))
+
+	backend := withDryRun(newGithubBackend(), dryRun)
+	j := newJob(ApprovalTargetWorkflow, wf.Name, user, approvers, backend.Name(), wf.TriggerRequest(variables),
+		releaseMessages{
+			Running: "Running Github workflow *" + wf.Name + "*",
+			Success: ":white_check_mark: That was a success! (workflow: *" + wf.Name + "*)",
+			Failure: ":x: Something went wrong while running the Github workflow *" + wf.Name + "*!",
+		},
+	)
+	j.Channel = channel
+	j.Timestamp = timestamp
+	return runJob(ctx, api, backend, j)
+}